@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// CloudInitConfig sets a clone's cloud-init settings before it first boots, so each desktop gets its own identity
+// rather than the template's. Every field is a text/template, see CloudInitTemplateData, and anything empty keeps
+// the template's value
+type CloudInitConfig struct {
+	// Hostname for the desktop, which PVE passes on to cloud-init as the VM's name
+	Hostname string `json:"hostname,omitempty"`
+
+	// User cloud-init creates, and the SSH keys allowed to log in as them
+	User    string   `json:"user,omitempty"`
+	SshKeys []string `json:"ssh_keys,omitempty"`
+
+	// Network settings per NIC, keyed by number, such as {"0": "ip=dhcp"}
+	IpConfig map[string]string `json:"ip_config,omitempty"`
+
+	Nameserver   string `json:"nameserver,omitempty"`
+	SearchDomain string `json:"search_domain,omitempty"`
+
+	// Custom snippets replacing the generated config, in PVE's cicustom syntax such as
+	// "user=local:snippets/desktop.yaml"
+	Custom string `json:"custom,omitempty"`
+}
+
+// CloudInitTemplateData is what cloud-init settings can refer to, such as {{.User}}
+type CloudInitTemplateData struct {
+	// The user's PVE username without the realm, such as jsmith for jsmith@pve, and the realm on its own
+	User  string
+	Realm string
+
+	// Hostname of the thin client the user is sitting at
+	ClientHostname string
+
+	// The desktop the user picked, and the clone made for them
+	Template string
+	VmId     int32
+	Node     string
+}
+
+var (
+	ipConfigKeyPattern  = regexp.MustCompile(`^\d+$`)
+	hostnameUnsafeChars = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+func validateCloudInit(cloudInit CloudInitConfig) error {
+	for nic := range cloudInit.IpConfig {
+		if !ipConfigKeyPattern.MatchString(nic) {
+			return fmt.Errorf("ip_config keys are NIC numbers such as 0, not %s\n", nic)
+		}
+	}
+
+	// Catch template syntax errors at startup rather than when someone connects
+	for _, field := range cloudInitFields(cloudInit) {
+		_, err := template.New("cloud-init").Parse(field)
+		if err != nil {
+			return fmt.Errorf("error while parsing %q: %+v\n", field, err)
+		}
+	}
+
+	return nil
+}
+
+// Empty reports whether there's nothing to set at all
+func (cloudInit CloudInitConfig) Empty() bool {
+	return strings.Join(cloudInitFields(cloudInit), "") == ""
+}
+
+// cloudInitFields is every templated setting, for checking them all in one go
+func cloudInitFields(cloudInit CloudInitConfig) []string {
+	fields := []string{cloudInit.Hostname, cloudInit.User, cloudInit.Nameserver, cloudInit.SearchDomain, cloudInit.Custom}
+	fields = append(fields, cloudInit.SshKeys...)
+	for _, ipConfig := range cloudInit.IpConfig {
+		fields = append(fields, ipConfig)
+	}
+
+	return fields
+}
+
+func cloudInitTemplateData(creds ProxmoxCreds, template ProxmoxVm, clone ProxmoxVm) CloudInitTemplateData {
+	user, realm, _ := strings.Cut(creds.Username, "@")
+
+	clientHostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("Couldn't read this client's hostname: %+v\n", err)
+	}
+
+	return CloudInitTemplateData{
+		User:           user,
+		Realm:          realm,
+		ClientHostname: clientHostname,
+		Template:       template.Name,
+		VmId:           clone.VmNumber,
+		Node:           clone.Node,
+	}
+}
+
+// renderCloudInit fills in the template's cloud-init settings as the parameters for PVE's config API
+func renderCloudInit(cloudInit CloudInitConfig, data CloudInitTemplateData) (url.Values, error) {
+	render := func(field string) (string, error) {
+		rendered, err := renderArgs([]string{field}, data)
+		if err != nil || len(rendered) == 0 {
+			return "", err
+		}
+		return strings.TrimSpace(rendered[0]), nil
+	}
+
+	params := url.Values{}
+	setParam := func(key string, field string) error {
+		value, err := render(field)
+		if err != nil {
+			return fmt.Errorf("error while filling in cloud-init %s: %w\n", key, err)
+		}
+		if value != "" {
+			params.Set(key, value)
+		}
+		return nil
+	}
+
+	hostname, err := render(cloudInit.Hostname)
+	if err != nil {
+		return nil, fmt.Errorf("error while filling in cloud-init hostname: %w\n", err)
+	}
+	if hostname = safeHostname(hostname); hostname != "" {
+		params.Set("name", hostname)
+	}
+
+	for key, field := range map[string]string{
+		"ciuser":       cloudInit.User,
+		"nameserver":   cloudInit.Nameserver,
+		"searchdomain": cloudInit.SearchDomain,
+		"cicustom":     cloudInit.Custom,
+	} {
+		if err := setParam(key, field); err != nil {
+			return nil, err
+		}
+	}
+
+	for nic, field := range cloudInit.IpConfig {
+		if err := setParam(fmt.Sprintf("ipconfig%s", nic), field); err != nil {
+			return nil, err
+		}
+	}
+
+	sshKeys := make([]string, 0, len(cloudInit.SshKeys))
+	for _, field := range cloudInit.SshKeys {
+		key, err := render(field)
+		if err != nil {
+			return nil, fmt.Errorf("error while filling in cloud-init SSH key: %w\n", err)
+		}
+		if key != "" {
+			sshKeys = append(sshKeys, key)
+		}
+	}
+	if len(sshKeys) > 0 {
+		// PVE wants the keys URL encoded on top of the form encoding, with spaces as %20 rather than +
+		params.Set("sshkeys", strings.ReplaceAll(url.QueryEscape(strings.Join(sshKeys, "\n")), "+", "%20"))
+	}
+
+	return params, nil
+}
+
+// safeHostname squashes a name down to a valid hostname label: lower case letters, digits and hyphens, at most 63
+// characters and not starting or ending with a hyphen
+func safeHostname(name string) string {
+	name = hostnameUnsafeChars.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+
+	return strings.Trim(name, "-")
+}
+
+// customizeClone applies the template's cloud-init settings to the clone. PVE regenerates the cloud-init drive
+// when the VM starts, so this has to happen between cloning and starting
+func customizeClone(creds ProxmoxCreds, token ProxmoxAuth, template ProxmoxVm, clone ProxmoxVm) error {
+	cloudInit := templateConfig(template).CloudInit
+
+	params, err := renderCloudInit(cloudInit, cloudInitTemplateData(creds, template, clone))
+	if err != nil {
+		return err
+	}
+	if len(params) == 0 {
+		return nil
+	}
+
+	// Without a cloud-init drive the settings are saved but nothing in the guest ever reads them
+	vmConfig, err := getVmConfig(creds, token, clone)
+	if err != nil {
+		return fmt.Errorf("error while reading the clone's config: %w\n", err)
+	}
+	if !hasCloudInitDrive(vmConfig) {
+		log.Printf("Template %s has cloud-init settings but no cloud-init drive, they won't reach the guest\n", template.Name)
+	}
+
+	return setVmConfig(creds, token, clone, params)
+}
+
+func hasCloudInitDrive(vmConfig ProxmoxVmConfig) bool {
+	for key := range vmConfig {
+		if strings.Contains(vmConfig.Get(key), "cloudinit") && !strings.HasPrefix(key, "ci") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRenderCloudInit(t *testing.T) {
+	data := CloudInitTemplateData{User: "jsmith", Realm: "pve", ClientHostname: "thin-07", Template: "Windows 11", VmId: 1234, Node: "pve1"}
+
+	tests := []struct {
+		name      string
+		cloudInit CloudInitConfig
+		want      url.Values
+		wantErr   bool
+	}{
+		{
+			name: "nothing set",
+			want: url.Values{},
+		},
+		{
+			name:      "hostname is made safe",
+			cloudInit: CloudInitConfig{Hostname: "{{.Template}}-{{.User}}_{{.VmId}}"},
+			want:      url.Values{"name": {"windows-11-jsmith-1234"}},
+		},
+		{
+			name:      "hostname with nothing usable left",
+			cloudInit: CloudInitConfig{Hostname: "__"},
+			want:      url.Values{},
+		},
+		{
+			name: "plain settings",
+			cloudInit: CloudInitConfig{
+				User:         "{{.User}}",
+				IpConfig:     map[string]string{"0": "ip=dhcp", "1": ""},
+				Nameserver:   "10.0.0.53",
+				SearchDomain: "{{.Realm}}.example.com",
+			},
+			want: url.Values{
+				"ciuser":       {"jsmith"},
+				"ipconfig0":    {"ip=dhcp"},
+				"nameserver":   {"10.0.0.53"},
+				"searchdomain": {"pve.example.com"},
+			},
+		},
+		{
+			// The extra layer of encoding is what PVE expects, url.Values adds the form encoding on top when sent
+			name: "ssh keys are URL encoded with spaces as %20",
+			cloudInit: CloudInitConfig{SshKeys: []string{
+				"ssh-ed25519 AAAAC3Nza+/b= {{.User}}@{{.ClientHostname}}",
+				"  ",
+				"ssh-rsa AAAAB3Nza admin",
+			}},
+			want: url.Values{"sshkeys": {"ssh-ed25519%20AAAAC3Nza%2B%2Fb%3D%20jsmith%40thin-07%0Assh-rsa%20AAAAB3Nza%20admin"}},
+		},
+		{
+			name:      "ssh keys that render empty are left out",
+			cloudInit: CloudInitConfig{SshKeys: []string{"{{if false}}ssh-rsa AAAA{{end}}"}},
+			want:      url.Values{},
+		},
+		{
+			name:      "unknown template field",
+			cloudInit: CloudInitConfig{User: "{{.Username}}"},
+			wantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := renderCloudInit(test.cloudInit, data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("renderCloudInit() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if got.Encode() != test.want.Encode() {
+				t.Errorf("renderCloudInit() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSafeHostname(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"desktop", "desktop"},
+		{"Windows 11 (Dev)", "windows-11-dev"},
+		{"-jsmith@pve-", "jsmith-pve"},
+		{"ünïcode", "n-code"},
+		{"", ""},
+		{"a123456789b123456789c123456789d123456789e123456789f123456789g123456789", "a123456789b123456789c123456789d123456789e123456789f123456789g12"},
+		{"a12345678901234567890123456789012345678901234567890123456789012-b", "a12345678901234567890123456789012345678901234567890123456789012"},
+		{"a1234567890123456789012345678901234567890123456789012345678901-b", "a1234567890123456789012345678901234567890123456789012345678901"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := safeHostname(test.name); got != test.want {
+				t.Errorf("safeHostname(%q) = %q, want %q", test.name, got, test.want)
+			}
+		})
+	}
+}
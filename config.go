@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+type VdiConfig struct {
+	// Manually pinned addresses for nodes, keyed by node name. These take priority over anything discovered
+	NodeAddresses map[string]string `json:"node_addresses,omitempty"`
+
+	// How SPICE traffic reaches the VM: "cluster" (default), "dedicated" or "direct"
+	SpiceProxyMode string `json:"spice_proxy_mode,omitempty"`
+
+	// Host running spiceproxy when SpiceProxyMode is "dedicated"
+	SpiceProxy string `json:"spice_proxy,omitempty"`
+
+	// Default clone placement policy, see the Placement* constants
+	Placement string `json:"placement,omitempty"`
+
+	// Per-template settings, keyed by either VM ID or template name
+	Templates map[string]TemplateConfig `json:"templates,omitempty"`
+
+	// Defaults for `pvevdi rebalance`, all of which can be overridden on the command line
+	Rebalance RebalanceConfig `json:"rebalance,omitempty"`
+
+	// How long each step of bringing up a desktop is allowed to take
+	Timeouts TimeoutConfig `json:"timeouts,omitempty"`
+
+	// How often the desktop list is refreshed in the background
+	RefreshInterval Duration `json:"refresh_interval,omitempty"`
+
+	// How the desktop list is grouped, see the GroupBy* constants
+	GroupBy string `json:"group_by,omitempty"`
+
+	// Icons for each OS family (linux, windows, solaris, other), either a theme icon name or a path to an image
+	OsIcons map[string]string `json:"os_icons,omitempty"`
+	// Thin client settings, see kiosk.go
+	Kiosk KioskConfig `json:"kiosk,omitempty"`
+
+	// USB redirection rules for every desktop on this client
+	Usb UsbPolicy `json:"usb,omitempty"`
+
+	// Settings written into every .vv file, see virtViewer.go
+	ConnectionFile ConnectionFileSettings `json:"connection_file,omitempty"`
+
+	// Which program shows the desktop, see viewer.go
+	Viewer ViewerConfig `json:"viewer,omitempty"`
+
+	// RDP client settings for templates using the rdp protocol, see rdp.go
+	Rdp RdpConfig `json:"rdp,omitempty"`
+
+	// Displays for desktops shown on this client, see monitors.go
+	Monitors MonitorConfig `json:"monitors,omitempty"`
+}
+
+type TimeoutConfig struct {
+	Clone   Duration `json:"clone,omitempty"`
+	Start   Duration `json:"start,omitempty"`
+	Stop    Duration `json:"stop,omitempty"`
+	Destroy Duration `json:"destroy,omitempty"`
+	Ready   Duration `json:"ready,omitempty"`
+	Migrate Duration `json:"migrate,omitempty"`
+
+	// Upper bound on everything between clicking a desktop and the viewer opening
+	Overall Duration `json:"overall,omitempty"`
+}
+
+// Duration lets durations be written as "90s" or "5m" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return fmt.Errorf("durations must be strings such as \"5m\": %+v", err)
+	}
+
+	duration.Duration, err = time.ParseDuration(text)
+	return err
+}
+
+type TemplateConfig struct {
+	// Overrides the default placement policy for clones of this template
+	Placement string `json:"placement,omitempty"`
+
+	// Nodes clones of this template may be placed on. Empty means any node
+	Nodes []string `json:"nodes,omitempty"`
+
+	// How to tell the clone is ready for the user to connect
+	Readiness ReadinessConfig `json:"readiness,omitempty"`
+
+	// USB redirection rules for this template, checked before the client's own
+	Usb UsbPolicy `json:"usb,omitempty"`
+
+	// .vv settings for this template, overriding the client's
+	ConnectionFile ConnectionFileSettings `json:"connection_file,omitempty"`
+
+	// Viewer for this template, overriding the client's. Args and Env are added to the client's
+	Viewer ViewerConfig `json:"viewer,omitempty"`
+
+	// How to reach the desktop, see the Protocol* constants. Defaults to auto
+	Protocol string `json:"protocol,omitempty"`
+
+	// RDP client for this template, overriding the client's. ExtraArgs and Env are added to the client's
+	Rdp RdpConfig `json:"rdp,omitempty"`
+
+	// Hardware sizes users can pick for their clone, keyed by name, see sizes.go
+	Sizes map[string]SizePreset `json:"sizes,omitempty"`
+
+	// Size everyone gets unless they pick another. Empty means the template's own hardware
+	DefaultSize string `json:"default_size,omitempty"`
+
+	// Cloud-init settings for each clone, see cloudInit.go
+	CloudInit CloudInitConfig `json:"cloud_init,omitempty"`
+}
+
+const (
+	SpiceProxyCluster   = "cluster"
+	SpiceProxyDedicated = "dedicated"
+	SpiceProxyDirect    = "direct"
+)
+
+var config VdiConfig
+
+// templateConfig looks up the settings for a template, preferring a match on VM ID over name
+func templateConfig(vm ProxmoxVm) TemplateConfig {
+	if templateCfg, exists := config.Templates[fmt.Sprint(vm.VmNumber)]; exists {
+		return templateCfg
+	}
+
+	return config.Templates[vm.Name]
+}
+
+func configPath() string {
+	if path, exists := os.LookupEnv("PVE_VDI_CONFIG"); exists {
+		return path
+	}
+
+	return "config.json"
+}
+
+// loadConfig reads the optional client configuration. A missing file isn't an error, everything has a default
+func loadConfig() (VdiConfig, error) {
+	var cfg VdiConfig
+	path := configPath()
+
+	configHandler, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, validateConfig(&cfg)
+	} else if err != nil {
+		return VdiConfig{}, fmt.Errorf("error while opening config file %s: %+v\n", path, err)
+	}
+	defer func(configHandler *os.File) {
+		err := configHandler.Close()
+		if err != nil {
+			log.Printf("error while closing config handler: %+v\n", err)
+		}
+	}(configHandler)
+
+	configData, err := io.ReadAll(configHandler)
+	if err != nil {
+		return VdiConfig{}, fmt.Errorf("error while reading config file %s: %+v\n", path, err)
+	}
+
+	err = json.Unmarshal(configData, &cfg)
+	if err != nil {
+		return VdiConfig{}, fmt.Errorf("error while unmarshalling config file %s: %+v\n", path, err)
+	}
+
+	err = validateConfig(&cfg)
+	if err != nil {
+		return VdiConfig{}, err
+	}
+
+	return cfg, nil
+}
+
+// validateConfig fills in defaults and rejects settings we don't understand
+func validateConfig(cfg *VdiConfig) error {
+	switch cfg.SpiceProxyMode {
+	case "":
+		cfg.SpiceProxyMode = SpiceProxyCluster
+	case SpiceProxyCluster, SpiceProxyDirect:
+	case SpiceProxyDedicated:
+		if cfg.SpiceProxy == "" {
+			return fmt.Errorf("spice_proxy must be set when spice_proxy_mode is %s\n", SpiceProxyDedicated)
+		}
+	default:
+		return fmt.Errorf("unknown spice_proxy_mode %s\n", cfg.SpiceProxyMode)
+	}
+
+	for name, templateCfg := range cfg.Templates {
+		if templateCfg.Placement != "" && !validPlacement(templateCfg.Placement) {
+			return fmt.Errorf("unknown placement %s for template %s\n", templateCfg.Placement, name)
+		}
+
+		if templateCfg.Readiness.Probe != "" && !validReadinessProbe(templateCfg.Readiness.Probe) {
+			return fmt.Errorf("unknown readiness probe %s for template %s\n", templateCfg.Readiness.Probe, name)
+		}
+
+		if templateCfg.Viewer.Type != "" && !validViewer(templateCfg.Viewer.Type) {
+			return fmt.Errorf("unknown viewer %s for template %s\n", templateCfg.Viewer.Type, name)
+		}
+
+		if err := validateUsbPolicy(templateCfg.Usb); err != nil {
+			return fmt.Errorf("bad USB policy for template %s: %+v\n", name, err)
+		}
+
+		if templateCfg.Protocol != "" && !validProtocol(templateCfg.Protocol) {
+			return fmt.Errorf("unknown protocol %s for template %s\n", templateCfg.Protocol, name)
+		}
+
+		if err := validateRdpConfig(templateCfg.Rdp); err != nil {
+			return fmt.Errorf("bad RDP settings for template %s: %+v\n", name, err)
+		}
+
+		if err := validateSizes(templateCfg); err != nil {
+			return fmt.Errorf("bad sizes for template %s: %+v\n", name, err)
+		}
+
+		if err := validateCloudInit(templateCfg.CloudInit); err != nil {
+			return fmt.Errorf("bad cloud-init settings for template %s: %+v\n", name, err)
+		}
+	}
+
+	if cfg.Viewer.Type == "" {
+		cfg.Viewer.Type = ViewerRemoteViewer
+	} else if !validViewer(cfg.Viewer.Type) {
+		return fmt.Errorf("unknown viewer %s\n", cfg.Viewer.Type)
+	}
+	if strings.Compare(cfg.Viewer.Type, ViewerSpicy) == 0 && !cfg.Viewer.AllowTicketOnCommandLine {
+		log.Printf("The spicy viewer passes the SPICE ticket on its command line, it won't run until allow_ticket_on_command_line is set\n")
+	}
+
+	if err := validateUsbPolicy(cfg.Usb); err != nil {
+		return fmt.Errorf("bad USB policy: %+v\n", err)
+	}
+
+	if err := validateMonitorConfig(&cfg.Monitors); err != nil {
+		return fmt.Errorf("bad monitor settings: %+v\n", err)
+	}
+
+	if err := validateRdpConfig(cfg.Rdp); err != nil {
+		return fmt.Errorf("bad RDP settings: %+v\n", err)
+	}
+	if cfg.Rdp.Client == "" {
+		cfg.Rdp.Client = "xfreerdp"
+	}
+	if len(cfg.Rdp.Args) == 0 {
+		cfg.Rdp.Args = defaultRdpArgs
+	}
+	if cfg.Rdp.Port == 0 {
+		cfg.Rdp.Port = 3389
+	}
+
+	if cfg.GroupBy == "" {
+		cfg.GroupBy = GroupByPool
+	} else if !validGroupBy(cfg.GroupBy) {
+		return fmt.Errorf("unknown group_by %s\n", cfg.GroupBy)
+	}
+
+	if cfg.Placement == "" {
+		cfg.Placement = PlacementSameAsTemplate
+	} else if !validPlacement(cfg.Placement) {
+		return fmt.Errorf("unknown placement %s\n", cfg.Placement)
+	}
+
+	setDefaultDuration(&cfg.Timeouts.Clone, 15*time.Minute)
+	setDefaultDuration(&cfg.Timeouts.Start, 2*time.Minute)
+	setDefaultDuration(&cfg.Timeouts.Stop, 2*time.Minute)
+	setDefaultDuration(&cfg.Timeouts.Destroy, 5*time.Minute)
+	setDefaultDuration(&cfg.Timeouts.Ready, 5*time.Minute)
+	setDefaultDuration(&cfg.Timeouts.Migrate, 30*time.Minute)
+	setDefaultDuration(&cfg.Timeouts.Overall, 30*time.Minute)
+	setDefaultDuration(&cfg.RefreshInterval, 30*time.Second)
+	setDefaultDuration(&cfg.Kiosk.IdleTimeout, 5*time.Minute)
+
+	if cfg.Kiosk.UnlockShortcut == "" {
+		cfg.Kiosk.UnlockShortcut = "Ctrl+Alt+Shift+U"
+	}
+	if cfg.Kiosk.Realm == "" {
+		cfg.Kiosk.Realm = "pve"
+	}
+
+	if cfg.Rebalance.Threshold == nil {
+		threshold := 0.2
+		cfg.Rebalance.Threshold = &threshold
+	}
+	if cfg.Rebalance.MaxConcurrent == 0 {
+		cfg.Rebalance.MaxConcurrent = 2
+	}
+	if cfg.Rebalance.MaxMigrations == 0 {
+		cfg.Rebalance.MaxMigrations = 10
+	}
+
+	return nil
+}
+
+func setDefaultDuration(duration *Duration, fallback time.Duration) {
+	if duration.Duration == 0 {
+		duration.Duration = fallback
+	}
+}
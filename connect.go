@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ConnectProgress receives updates from connectToDesktop, always from the goroutine doing the connecting
+type ConnectProgress struct {
+	// Human readable description of the current step
+	Status func(status string)
+
+	// Completion of the current task, or -1 when the task doesn't report any
+	Percent func(percent int)
+
+	// Raw task log output, one line at a time
+	Log func(line string)
+}
+
+// Matches the "(12.34%)" style progress that qmclone and friends print
+var taskPercentPattern = regexp.MustCompile(`(\d+(?:\.\d+)?)%`)
+
+// connectToDesktop clones template, boots the clone and hands it over to the viewer. It blocks until the viewer
+// exits and the clone has been removed, so it must never be run on the Qt thread. Progress is reported through status as human readable text.
+// size is one of the template's size presets, or empty for its default.
+// Cancelling ctx aborts whatever is in progress, tears down the clone and returns context.Canceled.
+func connectToDesktop(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, router *NodeRouter, template ProxmoxVm, size string, progress ConnectProgress) (err error) {
+	status := progress.Status
+
+	// Check the size before cloning anything, there's no point making a desktop the user can't have
+	preset, err := resolveSize(template, creds.Username, size)
+	if err != nil {
+		return err
+	}
+
+	// The overall deadline only covers getting the desktop ready, not the session itself
+	ctx, cancelOverall := context.WithTimeoutCause(ctx, config.Timeouts.Overall.Duration, fmt.Errorf("%w preparing the desktop after %s", errPhaseTimeout, config.Timeouts.Overall.Duration))
+	defer cancelOverall()
+
+	specifiedNode := creds
+	specifiedNode.Server = template.Node
+	specifiedToken := token
+
+	// Only talk to the VM's node directly if we've been told to, otherwise the API node proxies for us
+	if strings.Compare(config.SpiceProxyMode, SpiceProxyDirect) == 0 && strings.Compare(creds.Server, template.Node) != 0 {
+		status(fmt.Sprintf("Looking for node %s", template.Node))
+
+		nodeAddress, err := router.Resolve(template.Node)
+		if err != nil {
+			return fmt.Errorf("error while finding an address for node %s: %w\n", template.Node, err)
+		}
+		specifiedNode.Address = nodeAddress
+
+		specifiedToken, err = connectToProxmox(specifiedNode)
+		if err != nil {
+			// The node may have moved address since we found it, so look it up again next time
+			router.Forget(template.Node)
+			return fmt.Errorf("error while connecting to the node %s: %w\n", specifiedNode.Server, err)
+		}
+	}
+
+	status("Choosing a node")
+	target, err := chooseCloneTarget(ctx, specifiedNode, specifiedToken, template)
+	if err != nil {
+		return fmt.Errorf("error while choosing a node for the clone: %w\n", err)
+	}
+
+	// Last chance to back out before there's a clone to clean up
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	status("Cloning")
+	clonedVm, job, err := cloneTemplate(specifiedNode, specifiedToken, template, target)
+	if err != nil {
+		return fmt.Errorf("error while cloning VM: %w\n", err)
+	}
+	log.Printf("Sent clone VM Job\n")
+
+	// From here on any failure, cancellation or timeout leaves a half built desktop behind that needs removing
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if errors.Is(err, context.Canceled) {
+			status("Cancelling")
+		} else {
+			status("Cleaning up")
+		}
+		abortClone(specifiedNode, specifiedToken, job, clonedVm)
+	}()
+
+	_, err = followJob(ctx, specifiedNode, specifiedToken, job, waitOptions("clone", config.Timeouts.Clone.Duration), progress)
+	if err != nil {
+		return err
+	}
+
+	err = tagVdiClone(specifiedNode, specifiedToken, clonedVm, template)
+	if err != nil {
+		log.Printf("Couldn't tag clone %d as a VDI desktop: %+v\n", clonedVm.VmNumber, err)
+	}
+
+	// Multiple displays mean a different virtual graphics card, which can't change once the VM is running
+	err = configureDisplays(specifiedNode, specifiedToken, clonedVm, template)
+	if err != nil {
+		log.Printf("Couldn't set up displays for %d, carrying on with the template's: %+v\n", clonedVm.VmNumber, err)
+	}
+
+	if size != "" || templateConfig(template).DefaultSize != "" {
+		status("Resizing")
+		err = applySize(ctx, specifiedNode, specifiedToken, clonedVm, preset, progress)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !templateConfig(template).CloudInit.Empty() {
+		status("Customising")
+		err = customizeClone(specifiedNode, specifiedToken, template, clonedVm)
+		if err != nil {
+			return fmt.Errorf("error while applying cloud-init settings: %w\n", err)
+		}
+	}
+
+	status("Starting")
+	startJob, err := startVM(specifiedNode, specifiedToken, clonedVm)
+	if err != nil {
+		return fmt.Errorf("error while starting VM: %w\n", err)
+	}
+	log.Printf("Starting VM\n")
+
+	_, err = followJob(ctx, specifiedNode, specifiedToken, startJob, waitOptions("VM start", config.Timeouts.Start.Duration), progress)
+	if err != nil {
+		return err
+	}
+
+	spiceProxy, err := router.SpiceProxy(clonedVm.Node)
+	if err != nil {
+		return fmt.Errorf("error while finding the SPICE proxy for node %s: %w\n", clonedVm.Node, err)
+	}
+
+	status("Waiting for the desktop")
+	progress.Percent(-1)
+
+	err = waitForDesktop(ctx, specifiedNode, specifiedToken, template, clonedVm, spiceProxy)
+	if err != nil {
+		return err
+	}
+
+	status("Started!")
+
+	vmConfig, err := getVmConfig(specifiedNode, specifiedToken, clonedVm)
+	if err != nil {
+		return fmt.Errorf("error while reading the desktop's config: %w\n", err)
+	}
+
+	if strings.Compare(sessionProtocol(template, vmConfig), ProtocolRdp) == 0 {
+		err = connectRdp(ctx, specifiedNode, specifiedToken, template, clonedVm, status)
+	} else {
+		err = connectViewer(ctx, specifiedNode, specifiedToken, template, clonedVm, vmConfig, spiceProxy, status)
+	}
+
+	// Sessions can easily outlast the ticket, and cleaning up needs a working one either way
+	renewedToken, renewErr := connectToProxmox(specifiedNode)
+	if renewErr != nil {
+		log.Printf("Error while renewing Proxmox ticket: %+v\n", renewErr)
+	} else {
+		specifiedToken = renewedToken
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// The desktop is single use, so it goes as soon as the user's done with it
+	status("Ending session")
+	cleanupErr := destroyClone(context.Background(), specifiedNode, specifiedToken, clonedVm)
+	if cleanupErr != nil {
+		log.Printf("Couldn't remove desktop %d after the session ended: %+v\n", clonedVm.VmNumber, cleanupErr)
+	}
+
+	return nil
+}
+
+// connectViewer hands the clone over to the viewer, over SPICE or VNC, and blocks until the user closes it
+func connectViewer(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, template ProxmoxVm, clone ProxmoxVm, vmConfig ProxmoxVmConfig, spiceProxy string, status func(string)) error {
+	var connectionFile *VirtViewerFile
+	var err error
+
+	protocol := sessionProtocol(template, vmConfig)
+	if strings.Compare(protocol, ProtocolSpice) == 0 && !spiceAvailable(vmConfig) {
+		return fmt.Errorf("the template is set to SPICE but has a %s display, it needs a qxl display for SPICE\n", displayType(vmConfig))
+	}
+
+	if strings.Compare(protocol, ProtocolSpice) == 0 {
+		connectionFile, err = connectToSpice(creds, token, clone, template, spiceProxy)
+		if err != nil {
+			return fmt.Errorf("couldn't connect to VM: %w\n", err)
+		}
+	} else {
+		log.Printf("Connecting to %d over VNC, it has a %s display\n", clone.VmNumber, displayType(vmConfig))
+		status("Connecting over VNC")
+
+		bridge, err := startVncBridge(ctx, creds, token, clone)
+		if err != nil {
+			return err
+		}
+		defer bridge.Close()
+
+		connectionFile, err = bridge.ConnectionFile(template)
+		if err != nil {
+			return fmt.Errorf("couldn't connect to VM: %w\n", err)
+		}
+	}
+
+	status("Connected")
+	return launchViewer(template, connectionFile)
+}
+
+// followJob waits for a task to finish, passing its log and any progress it reports on to progress. A task that
+// finishes unsuccessfully is returned as a TaskFailedError
+func followJob(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, job ProxmoxJobStatus, opts WaitOptions, progress ConnectProgress) (ProxmoxJobStatus, error) {
+	// PVE numbers log lines from 1 and start is how many to skip, so this is also the last line we've seen
+	nextLine := 0
+	progress.Percent(-1)
+
+	final, err := waitForTask(ctx, creds, token, job, opts, func(ProxmoxJobStatus) {
+		// A missing log isn't worth failing over, the status is what matters
+		lines, err := getJobLog(creds, token, job, nextLine)
+		if err != nil {
+			log.Printf("Couldn't read log for task %s: %+v\n", job.JobId, err)
+		}
+
+		for _, line := range lines {
+			// PVE answers with a "no content" placeholder line when there's nothing new
+			if line.LineNumber <= nextLine || strings.Compare(line.Text, "no content") == 0 {
+				continue
+			}
+			nextLine = line.LineNumber
+
+			progress.Log(line.Text)
+			if matches := taskPercentPattern.FindAllStringSubmatch(line.Text, -1); len(matches) > 0 {
+				percent, err := strconv.ParseFloat(matches[len(matches)-1][1], 64)
+				if err == nil {
+					progress.Percent(int(percent))
+				}
+			}
+		}
+	})
+	if err != nil {
+		return final, err
+	}
+
+	// The task stopping only means it's finished, not that it worked
+	return final, checkTaskResult(creds, token, final, opts.Phase)
+}
+
+// abortClone stops the clone task if it's still going and destroys whatever it managed to create
+func abortClone(creds ProxmoxCreds, token ProxmoxAuth, job ProxmoxJobStatus, clone ProxmoxVm) {
+	// Whatever context the connection had is finished with by now, cleanup gets its own deadlines
+	ctx := context.Background()
+
+	jobStatus, err := getJobStatus(creds, token, job)
+	if err == nil && strings.Compare(jobStatus.Status, "stopped") != 0 {
+		err = stopJob(creds, token, job)
+		if err != nil {
+			log.Printf("Couldn't stop clone task %s: %+v\n", job.JobId, err)
+		}
+
+		_, err = waitForTask(ctx, creds, token, job, waitOptions("clone to stop", config.Timeouts.Stop.Duration), nil)
+		if err != nil {
+			log.Printf("Error while waiting for clone task %s to stop: %+v\n", job.JobId, err)
+		}
+	}
+
+	err = destroyClone(ctx, creds, token, clone)
+	if err != nil {
+		log.Printf("Couldn't remove clone %d: %+v\n", clone.VmNumber, err)
+	}
+}
+
+// destroyClone powers off and deletes a clone. A clone that never got created is not an error
+func destroyClone(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, clone ProxmoxVm) error {
+	vmStatus, err := getVmStatus(creds, token, clone)
+	if err != nil {
+		// PVE cleans up after aborted clones itself, so the VM may well not exist
+		log.Printf("Clone %d not found, assuming it's already gone: %+v\n", clone.VmNumber, err)
+		return nil
+	}
+
+	if strings.Compare(vmStatus, "running") == 0 {
+		job, err := stopVM(creds, token, clone)
+		if err != nil {
+			return fmt.Errorf("error while stopping VM: %w\n", err)
+		}
+
+		final, err := waitForTask(ctx, creds, token, job, waitOptions("VM stop", config.Timeouts.Stop.Duration), nil)
+		if err != nil {
+			return fmt.Errorf("error while waiting for VM to stop: %w\n", err)
+		}
+
+		err = checkTaskResult(creds, token, final, "VM stop")
+		if err != nil {
+			return err
+		}
+	}
+
+	job, err := destroyVM(creds, token, clone)
+	if err != nil {
+		return fmt.Errorf("error while destroying VM: %w\n", err)
+	}
+
+	final, err := waitForTask(ctx, creds, token, job, waitOptions("VM destroy", config.Timeouts.Destroy.Duration), nil)
+	if err != nil {
+		return fmt.Errorf("error while waiting for VM to be destroyed: %w\n", err)
+	}
+
+	return checkTaskResult(creds, token, final, "VM destroy")
+}
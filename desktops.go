@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+const (
+	GroupByPool = "pool"
+	GroupByTag  = "tag"
+	GroupByNone = "none"
+)
+
+func validGroupBy(groupBy string) bool {
+	switch groupBy {
+	case GroupByPool, GroupByTag, GroupByNone:
+		return true
+	default:
+		return false
+	}
+}
+
+// Group the desktop list falls under when no pool or tag applies
+const otherGroup = "Other"
+
+// Desktop is a single row in the desktop list
+type Desktop struct {
+	Vm        ProxmoxVm
+	NodeState NodeState
+
+	// The user's running clone of this desktop, if they've already got one
+	Session *ProxmoxVm
+
+	// PVE's ostype, such as l26 or win11. Empty if we couldn't read the VM's config
+	OsType string
+}
+
+func (desktop Desktop) Available() bool {
+	return desktop.NodeState.Available()
+}
+
+// StatusText is running/stopped/template, as PVE reports it
+func (desktop Desktop) StatusText() string {
+	if desktop.Vm.Template == 1 {
+		return "template"
+	}
+
+	return desktop.Vm.Status
+}
+
+// CpuText is the current CPU usage, only meaningful while the VM is running
+func (desktop Desktop) CpuText() string {
+	if strings.Compare(desktop.Vm.Status, "running") != 0 {
+		return fmt.Sprintf("%.0f vCPU", desktop.Vm.MaxCpu)
+	}
+
+	return fmt.Sprintf("%.0f%% of %.0f vCPU", desktop.Vm.Cpu*100, desktop.Vm.MaxCpu)
+}
+
+// MemoryText is the current memory usage, only meaningful while the VM is running
+func (desktop Desktop) MemoryText() string {
+	if strings.Compare(desktop.Vm.Status, "running") != 0 {
+		return fmt.Sprintf("%s GiB", formatGiB(desktop.Vm.MaxMem))
+	}
+
+	return fmt.Sprintf("%s / %s GiB", formatGiB(desktop.Vm.Mem), formatGiB(desktop.Vm.MaxMem))
+}
+
+// SessionText describes the user's running clone, or is empty if there isn't one
+func (desktop Desktop) SessionText() string {
+	if desktop.Session == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("Running on %s (%d)", desktop.Session.Node, desktop.Session.VmNumber)
+}
+
+// Group is the heading the desktop is listed under
+func (desktop Desktop) Group() string {
+	switch config.GroupBy {
+	case GroupByPool:
+		if desktop.Vm.Pool != "" {
+			return desktop.Vm.Pool
+		}
+	case GroupByTag:
+		for _, tag := range strings.Split(desktop.Vm.Tags, ";") {
+			if tag != "" {
+				return tag
+			}
+		}
+	case GroupByNone:
+		return "Desktops"
+	}
+
+	return otherGroup
+}
+
+// OsFamily boils ostype down to linux, windows, solaris or other
+func (desktop Desktop) OsFamily() string {
+	switch {
+	case strings.HasPrefix(desktop.OsType, "win") || strings.Compare(desktop.OsType, "wxp") == 0 || strings.Compare(desktop.OsType, "w2k") == 0:
+		return "windows"
+	case strings.HasPrefix(desktop.OsType, "l2"):
+		return "linux"
+	case strings.Compare(desktop.OsType, "solaris") == 0:
+		return "solaris"
+	default:
+		return "other"
+	}
+}
+
+// Matches reports whether the desktop turns up when searching for query
+func (desktop Desktop) Matches(query string) bool {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return true
+	}
+
+	for _, field := range []string{desktop.Vm.Name, desktop.Vm.Node, desktop.Vm.Pool, desktop.Vm.Tags, desktop.OsType} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The OS type of a desktop hardly ever changes, so it's only read once per VM rather than on every refresh
+var (
+	osTypeLock  sync.Mutex
+	osTypeCache = make(map[string]string)
+)
+
+func getOsType(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) string {
+	if osType, exists := cachedOsType(vm); exists {
+		return osType
+	}
+
+	// The lock isn't held while asking PVE, the worst that can happen is two refreshes both looking the same VM up
+	vmConfig, err := getVmConfig(creds, token, vm)
+	if err != nil {
+		// Don't cache the failure, the node might just be down for now
+		log.Printf("Couldn't read config for %s: %+v\n", vm.Name, err)
+		return ""
+	}
+
+	osTypeLock.Lock()
+	defer osTypeLock.Unlock()
+
+	osTypeCache[vm.Id] = vmConfig.Get("ostype")
+	return osTypeCache[vm.Id]
+}
+
+func cachedOsType(vm ProxmoxVm) (string, bool) {
+	osTypeLock.Lock()
+	defer osTypeLock.Unlock()
+
+	osType, exists := osTypeCache[vm.Id]
+	return osType, exists
+}
+
+func formatGiB(bytes int64) string {
+	return fmt.Sprintf("%.1f", float64(bytes)/(1<<30))
+}
+
+// listDesktops builds the desktop list out of the cluster resources. Clones we've made are hidden, they show up as
+// sessions against the desktop they came from instead
+func listDesktops(creds ProxmoxCreds, token ProxmoxAuth, resources ProxmoxVmList) []Desktop {
+	return buildDesktopList(creds.Username, resources, getNodeStates(creds, token, resources), func(vm ProxmoxVm) string {
+		return getOsType(creds, token, vm)
+	})
+}
+
+// listCachedDesktops builds the desktop list without talking to PVE at all, so it's safe on the Qt thread. Nodes in
+// maintenance and OS types we haven't seen yet only show up once the list is next refreshed
+func listCachedDesktops(username string, resources ProxmoxVmList) []Desktop {
+	return buildDesktopList(username, resources, resourceNodeStates(resources), func(vm ProxmoxVm) string {
+		osType, _ := cachedOsType(vm)
+		return osType
+	})
+}
+
+func buildDesktopList(username string, resources ProxmoxVmList, nodeStates map[string]NodeState, osType func(vm ProxmoxVm) string) []Desktop {
+	userTag := vdiUserTag(username)
+
+	desktops := make([]Desktop, 0)
+	for _, vm := range relocateDesktops(resources, nodeStates) {
+		if hasVdiTag(vm) {
+			continue
+		}
+
+		state := nodeStates[vm.Node]
+		state.Name = vm.Node
+		desktop := Desktop{Vm: vm, NodeState: state, OsType: osType(vm)}
+
+		for _, clone := range resources.Data {
+			if hasVdiTag(clone) && hasTag(clone, userTag) && hasTag(clone, vdiTemplateTag(vm)) && strings.Compare(clone.Status, "running") == 0 {
+				desktop.Session = &clone
+				break
+			}
+		}
+
+		desktops = append(desktops, desktop)
+	}
+
+	return desktops
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Favourites are remembered by desktop name, since the same desktop can move between nodes and VM IDs
+type Favourites map[string]bool
+
+func favouritesPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("error while finding the user config directory: %+v\n", err)
+	}
+
+	return filepath.Join(configDir, "pve-vdi", "favourites.json"), nil
+}
+
+// The favourites file holds everyone who signs in from this OS account, keyed by PVE username, since a kiosk
+// signs every user in as the same one
+type favouritesFile map[string][]string
+
+func readFavouritesFile(path string) (favouritesFile, error) {
+	file := make(favouritesFile)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return file, nil
+	} else if err != nil {
+		return file, fmt.Errorf("error while reading favourites: %+v\n", err)
+	}
+
+	// Older versions kept a single list, which can only have belonged to whoever uses this account. A kiosk has no
+	// way of telling whose it was, so there it's dropped
+	var names []string
+	if json.Unmarshal(data, &names) == nil {
+		if !config.Kiosk.Enabled {
+			file[""] = names
+		}
+		return file, nil
+	}
+
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return make(favouritesFile), fmt.Errorf("error while unmarshalling favourites: %+v\n", err)
+	}
+
+	return file, nil
+}
+
+// loadFavourites reads username's favourites. Not having any yet is not an error
+func loadFavourites(username string) (Favourites, error) {
+	favourites := make(Favourites)
+
+	path, err := favouritesPath()
+	if err != nil {
+		return favourites, err
+	}
+
+	file, err := readFavouritesFile(path)
+	if err != nil {
+		return favourites, err
+	}
+
+	names, exists := file[username]
+	if !exists {
+		names = file[""]
+	}
+	for _, name := range names {
+		favourites[name] = true
+	}
+
+	return favourites, nil
+}
+
+func saveFavourites(username string, favourites Favourites) error {
+	path, err := favouritesPath()
+	if err != nil {
+		return err
+	}
+
+	// Everyone else's favourites have to survive this user saving theirs
+	file, err := readFavouritesFile(path)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(favourites))
+	for name, favourite := range favourites {
+		if favourite {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	file[username] = names
+	delete(file, "")
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error while marshalling favourites: %+v\n", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("error while creating %s: %+v\n", filepath.Dir(path), err)
+	}
+
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("error while writing favourites: %+v\n", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFavouritesPerUser(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	if err := saveFavourites("alice@pve", Favourites{"Windows 11": true, "Ubuntu": true, "Gone": false}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveFavourites("bob@ldap", Favourites{"Fedora": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		want     []string
+	}{
+		{"alice@pve", []string{"Ubuntu", "Windows 11"}},
+		{"bob@ldap", []string{"Fedora"}},
+		{"alice@ldap", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.username, func(t *testing.T) {
+			favourites, err := loadFavourites(test.username)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(favourites) != len(test.want) {
+				t.Errorf("loadFavourites() = %v, want %v", favourites, test.want)
+			}
+			for _, name := range test.want {
+				if !favourites[name] {
+					t.Errorf("loadFavourites() = %v, missing %s", favourites, name)
+				}
+			}
+		})
+	}
+}
+
+func TestFavouritesLegacyList(t *testing.T) {
+	tests := []struct {
+		name  string
+		kiosk bool
+		want  int
+	}{
+		{"adopted by a desktop user", false, 2},
+		{"ignored by a kiosk", true, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+			config = VdiConfig{Kiosk: KioskConfig{Enabled: test.kiosk}}
+			t.Cleanup(func() { config = VdiConfig{} })
+
+			path, err := favouritesPath()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(`["Windows 11", "Ubuntu"]`), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			favourites, err := loadFavourites("alice@pve")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(favourites) != test.want {
+				t.Errorf("loadFavourites() = %v, want %d favourites", favourites, test.want)
+			}
+		})
+	}
+}
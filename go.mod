@@ -2,4 +2,7 @@ module pve-vdi
 
 go 1.24
 
-require github.com/mappu/miqt v0.11.0
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/mappu/miqt v0.11.0
+)
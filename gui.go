@@ -1,25 +1,26 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net/netip"
-	"os/exec"
-
 	"log"
-	"strconv"
+	"maps"
+	"os"
+	"slices"
 	"strings"
+	"time"
 
-	//"fmt"
 	"github.com/mappu/miqt/qt6"
-
-	//"log"
-	"os"
-	//"strconv"
-	//"strings"
+	"github.com/mappu/miqt/qt6/mainthread"
 )
 
-func buildWindow(vms ProxmoxVmList, creds ProxmoxCreds, token ProxmoxAuth) {
+// PVE tickets are good for two hours, this leaves plenty of room for a renewal to fail and be tried again
+const ticketRenewInterval = 30 * time.Minute
+
+// buildWindow runs the client until it's closed. In kiosk mode it starts at the sign in screen instead, and creds
+// only needs to say which server to sign in to
+func buildWindow(vms ProxmoxVmList, creds ProxmoxCreds, token ProxmoxAuth, router *NodeRouter) {
 	qt6.NewQApplication(os.Args)
 
 	// Create the home widget
@@ -27,208 +28,743 @@ func buildWindow(vms ProxmoxVmList, creds ProxmoxCreds, token ProxmoxAuth) {
 	defer homeWidget.Delete()
 	homeWidget.SetWindowTitle("Proxmox VDI Client")
 
+	// SetCentralWidget deletes whatever was there before, so screens are rebuilt every time we go back to them
+	var showHome func()
+	var showPicker func()
+	var showConnecting func(vm ProxmoxVm, size string)
+	var signOut func()
+	showHome = func() {
+		showPicker()
+	}
+
+	// Only kiosks sign people in and out, everywhere else the user in creds.json is the one and only user
+	var idleWatcher *IdleWatcher
+	if config.Kiosk.Enabled {
+		idleWatcher = newIdleWatcher(func() {
+			log.Printf("Signing %s out after %s idle\n", creds.Username, config.Kiosk.IdleTimeout.Duration)
+			signOut()
+		})
+
+		serverCreds := creds
+		showHome = func() {
+			idleWatcher.Stop()
+			homeWidget.SetCentralWidget(buildLogin(serverCreds, func(userCreds ProxmoxCreds, userToken ProxmoxAuth, userVms ProxmoxVmList) {
+				creds, token, vms = userCreds, userToken, userVms
+				router = newNodeRouter(creds, token)
+				showPicker()
+			}))
+		}
+		signOut = func() {
+			creds, token, vms = serverCreds, ProxmoxAuth{}, ProxmoxVmList{}
+			showHome()
+		}
+	}
+
+	showPicker = func() {
+		if idleWatcher != nil {
+			idleWatcher.Start()
+		}
+		homeWidget.SetCentralWidget(buildPicker(vms, creds, func() ProxmoxAuth {
+			return token
+		}, showConnecting, signOut))
+	}
+	showConnecting = func(vm ProxmoxVm, size string) {
+		// Nobody's idle while waiting for their desktop or using it
+		if idleWatcher != nil {
+			idleWatcher.Stop()
+		}
+		homeWidget.SetCentralWidget(buildConnecting(vm, size, creds, token, router, showPicker, func() {
+			showConnecting(vm, size)
+		}, func() {
+			// Kiosks sign the user out once they're done, the next person to sit down shouldn't get their desktops
+			if signOut != nil {
+				homeWidget.SetCentralWidget(buildSessionEnded(vm, signOut))
+			} else {
+				homeWidget.SetCentralWidget(buildSessionEnded(vm, showPicker))
+			}
+		}))
+	}
+
+	// Tickets only last a couple of hours but the client runs all day, so log in again well before ours runs out
+	renewTimer := qt6.NewQTimer2(homeWidget.QObject)
+	renewTimer.OnTimeout(func() {
+		// Signed out kiosks have nothing to renew
+		if token.Data.Ticket == "" {
+			return
+		}
+
+		renewCreds := creds
+		go func() {
+			renewed, err := connectToProxmox(renewCreds)
+			mainthread.Start(func() {
+				if err != nil {
+					log.Printf("Error while renewing Proxmox ticket: %+v\n", err)
+					return
+				}
+
+				// Someone else may have signed in while we were waiting
+				if strings.Compare(creds.Username, renewCreds.Username) != 0 {
+					return
+				}
+				token = renewed
+				router.SetToken(renewed)
+			})
+		}()
+	})
+	renewTimer.Start(int(ticketRenewInterval.Milliseconds()))
+
+	// Show the window
+	showHome()
+	if config.Kiosk.Enabled {
+		lockWindow(homeWidget)
+	} else {
+		homeWidget.Show()
+	}
+	qt6.QApplication_Exec()
+}
+
+// Columns in the desktop list
+const (
+	desktopColumnName = iota
+	desktopColumnStatus
+	desktopColumnNode
+	desktopColumnCpu
+	desktopColumnMemory
+	desktopColumnSession
+)
+
+// What the user chose to do about an error
+type errorChoice int
+
+const (
+	errorBack errorChoice = iota
+	errorRetry
+)
+
+// showError explains err in a modal dialog and asks the user whether to retry or go back. summary should say what
+// we were trying to do in terms the user understands, the technical detail is tucked away behind "Show Details"
+func showError(parent *qt6.QWidget, summary string, err error) errorChoice {
+	details := errorDetails(err)
+
+	for {
+		dialog := qt6.NewQMessageBox(parent)
+		dialog.SetIcon(qt6.QMessageBox__Critical)
+		dialog.SetWindowTitle("Proxmox VDI Client")
+		dialog.SetText(summary)
+		dialog.SetInformativeText(errorHeadline(err))
+		dialog.SetDetailedText(details)
+
+		retryButton := dialog.AddButton2("Retry", qt6.QMessageBox__AcceptRole)
+		backButton := dialog.AddButton2("Back", qt6.QMessageBox__RejectRole)
+		copyButton := dialog.AddButton2("Copy details", qt6.QMessageBox__ActionRole)
+		dialog.SetDefaultButton(retryButton)
+		dialog.SetEscapeButton(backButton.QAbstractButton)
+
+		dialog.Exec()
+		clicked := dialog.ClickedButton()
+		dialog.DeleteLater()
+
+		switch {
+		case clicked != nil && clicked.UnsafePointer() == retryButton.UnsafePointer():
+			return errorRetry
+		case clicked != nil && clicked.UnsafePointer() == copyButton.UnsafePointer():
+			// Any button closes the dialog, so bring it straight back after copying
+			qt6.QGuiApplication_Clipboard().SetText(fmt.Sprintf("%s\n\n%s", summary, details))
+		default:
+			return errorBack
+		}
+	}
+}
+
+// errorHeadline picks the single most useful line out of err
+func errorHeadline(err error) string {
+	var apiErr *ProxmoxApiError
+	var taskErr *TaskFailedError
+
+	switch {
+	case errors.As(err, &apiErr) && apiErr.Message != "":
+		return apiErr.Message
+	case errors.As(err, &apiErr):
+		return apiErr.Status
+	case errors.As(err, &taskErr):
+		return fmt.Sprintf("%s failed: %s", taskErr.Phase, taskErr.ExitStatus)
+	case errors.Is(err, errPhaseTimeout):
+		return "Proxmox took too long to respond"
+	}
+
+	headline, _, _ := strings.Cut(strings.TrimSpace(err.Error()), "\n")
+	return headline
+}
+
+// errorDetails lays out everything we know about err for whoever ends up troubleshooting it
+func errorDetails(err error) string {
+	var details strings.Builder
+
+	var apiErr *ProxmoxApiError
+	if errors.As(err, &apiErr) {
+		fmt.Fprintf(&details, "Request: %s %s\n", apiErr.Method, apiErr.Url)
+		fmt.Fprintf(&details, "Status: %s\n", apiErr.Status)
+		if apiErr.Message != "" {
+			fmt.Fprintf(&details, "PVE message: %s\n", apiErr.Message)
+		}
+		for _, parameter := range slices.Sorted(maps.Keys(apiErr.Errors)) {
+			fmt.Fprintf(&details, "  %s: %s\n", parameter, apiErr.Errors[parameter])
+		}
+		details.WriteString("\n")
+	}
+
+	var taskErr *TaskFailedError
+	if errors.As(err, &taskErr) {
+		fmt.Fprintf(&details, "Task: %s\n", taskErr.Job.JobId)
+		fmt.Fprintf(&details, "Exit status: %s\n", taskErr.ExitStatus)
+		if len(taskErr.LogTail) > 0 {
+			fmt.Fprintf(&details, "Task log:\n%s\n", strings.Join(taskErr.LogTail, "\n"))
+		}
+		details.WriteString("\n")
+	}
+
+	fmt.Fprintf(&details, "Error:\n%s", strings.TrimSpace(err.Error()))
+	return details.String()
+}
+
+// Heading for the user's pinned desktops, always listed first
+const favouritesGroup = "Favourites"
+
+// osIcon looks up the icon for an OS family, either from the config or the icon theme
+func osIcon(family string) *qt6.QIcon {
+	icon, configured := config.OsIcons[family]
+	if configured && strings.Contains(icon, "/") {
+		return qt6.NewQIcon4(icon)
+	} else if configured {
+		return qt6.QIcon_FromTheme2(icon, qt6.QIcon_FromTheme("computer"))
+	}
+
+	switch family {
+	case "windows":
+		return qt6.QIcon_FromTheme2("distributor-logo-windows", qt6.QIcon_FromTheme("computer"))
+	case "linux":
+		return qt6.QIcon_FromTheme2("distributor-logo", qt6.QIcon_FromTheme("computer"))
+	default:
+		return qt6.QIcon_FromTheme("computer")
+	}
+}
+
+// buildPicker creates the list of desktops, calling connect when the user picks one. The list keeps itself up to
+// date in the background for as long as it's on screen, using whatever ticket currentToken hands back at the time.
+// signOut is only set in kiosk mode
+func buildPicker(vms ProxmoxVmList, creds ProxmoxCreds, currentToken func() ProxmoxAuth, connect func(vm ProxmoxVm, size string), signOut func()) *qt6.QWidget {
 	// Build the layout
 	mainWindowLayout := qt6.NewQVBoxLayout2()
 
 	// Create header and add to layout
 	header := qt6.NewQLabel3("Choose the VM that you would like to connect to")
-	header.Show()
 	mainWindowLayout.AddWidget(header.QWidget)
 	mainWindowLayout.AddSpacing(header.Height() * 2)
 
 	// Create container widget
-	testWidget := qt6.NewQWidget(homeWidget.QWidget)
-	testWidget.SetLayout(mainWindowLayout.Layout())
-
-	// Create a button for every VM
-	for _, vm := range vms.Data {
-		// Ensure it's actually a VM we should present to the user
-		if strings.Contains(vm.Type, "qemu") {
-			var err error
-
-			// Create the button with the text as the name of the VM
-			vmButton := qt6.NewQPushButton3(vm.Name)
-			vmid, err := strconv.ParseInt(strings.Split(vm.Id, "/")[1], 10, 32)
-			if err != nil {
-				log.Fatalf("Error while parsing VM ID %s: %+v\n", vm.Id, err)
-			}
-			vm.VmNumber = int32(vmid)
+	pickerWidget := qt6.NewQWidget2()
+	pickerWidget.SetLayout(mainWindowLayout.Layout())
+
+	searchBox := qt6.NewQLineEdit2()
+	searchBox.SetPlaceholderText("Search desktops (Ctrl+F)")
+	searchBox.SetClearButtonEnabled(true)
+	mainWindowLayout.AddWidget(searchBox.QWidget)
+
+	desktopTree := qt6.NewQTreeWidget2()
+	desktopTree.SetHeaderLabels([]string{"Desktop", "Status", "Node", "CPU", "Memory", "Your session"})
+	mainWindowLayout.AddWidget(desktopTree.QWidget)
+
+	// Last time the list was refreshed, or why it couldn't be
+	refreshLabel := qt6.NewQLabel2()
+	mainWindowLayout.AddWidget(refreshLabel.QWidget)
+
+	buttonLayout := qt6.NewQHBoxLayout2()
+	refreshButton := qt6.NewQPushButton3("Refresh")
+	favouriteButton := qt6.NewQPushButton3("Add to favourites")
+	favouriteButton.SetEnabled(false)
+	connectButton := qt6.NewQPushButton3("Connect")
+	connectButton.SetEnabled(false)
+	// Only shown for desktops the user has a choice of sizes for
+	sizeBox := qt6.NewQComboBox2()
+	sizeBox.SetToolTip("Size of the desktop")
+	sizeBox.Hide()
+	buttonLayout.AddWidget(refreshButton.QWidget)
+	buttonLayout.AddWidget(favouriteButton.QWidget)
+	buttonLayout.AddStretch()
+	if signOut != nil {
+		signOutButton := qt6.NewQPushButton3("Sign out")
+		signOutButton.OnClicked(signOut)
+		buttonLayout.AddWidget(signOutButton.QWidget)
+	}
+	buttonLayout.AddWidget(sizeBox.QWidget)
+	buttonLayout.AddWidget(connectButton.QWidget)
+	mainWindowLayout.AddLayout(buttonLayout.QLayout)
 
-			// Start the VM (if necessary) and connect to vm.VmNumber the VM via SPICE.
-			vmButton.OnClicked(func() {
-				// Create the child window
-				fmt.Printf("Connecting to %s\n", vmButton.Text())
-				connectingWindow := qt6.NewQWidget2()
-				defer connectingWindow.Delete()
-				connectingWindow.SetWindowTitle(fmt.Sprintf("Connecting to %s", vmButton.Text()))
+	favourites, err := loadFavourites(creds.Username)
+	if err != nil {
+		log.Printf("Couldn't load favourites: %+v\n", err)
+	}
 
-				connectingLayout := qt6.NewQVBoxLayout2()
+	// Items only carry the VM's ID, the desktop itself is looked up here. Group headings don't have one
+	desktops := make(map[string]Desktop)
+	var lastList []Desktop
 
-				// Set connecting container widget settings
-				connectingWidget := qt6.NewQWidget(connectingWindow)
-				connectingWidget.SetLayout(connectingLayout.QLayout)
+	itemDesktop := func(item *qt6.QTreeWidgetItem) (Desktop, bool) {
+		if item == nil {
+			return Desktop{}, false
+		}
 
-				// Set window presentation settings
-				homeWidget.SetCentralWidget(connectingWidget)
+		desktop, exists := desktops[item.Data(desktopColumnName, int(qt6.UserRole)).ToString()]
+		return desktop, exists
+	}
 
-				// Build the layout for the child window
-				statusLabel := qt6.NewQLabel2()
-				vmNameLabel := qt6.NewQLabel2()
+	selectedDesktop := func() (Desktop, bool) {
+		item := desktopTree.CurrentItem()
+		if item == nil || item.IsDisabled() {
+			return Desktop{}, false
+		}
 
-				// Create the VM Name label
-				vmNameLabel.SetText(fmt.Sprintf("Virtual desktop chosen: %s\n", vmButton.Text()))
-				vmNameLabel.Show()
-				connectingLayout.AddWidget(vmNameLabel.QWidget)
-				connectingLayout.AddSpacing(vmNameLabel.Height())
+		return itemDesktop(item)
+	}
 
-				statusLabel.Show()
-				connectingLayout.AddWidget(statusLabel.QWidget)
-				connectingLayout.AddSpacing(statusLabel.Height())
+	updateButtons := func() {
+		desktop, selected := selectedDesktop()
+		connectButton.SetEnabled(selected)
 
-				specifiedNode, err := login()
-				var specifiedToken ProxmoxAuth
+		_, exists := itemDesktop(desktopTree.CurrentItem())
+		favouriteButton.SetEnabled(exists)
+		if exists && favourites[desktop.Vm.Name] {
+			favouriteButton.SetText("Remove from favourites")
+		} else {
+			favouriteButton.SetText("Add to favourites")
+		}
 
-				if err != nil {
-					statusLabel.SetText(fmt.Sprintf("Error: %s\n", err))
-				}
+		// Keep whatever size the user picked if it's still on offer
+		picked := sizeBox.CurrentData().ToString()
+		sizeBox.Clear()
+		sizes := availableSizes(desktop.Vm, creds.Username)
+		for _, size := range sizes {
+			label := size
+			if size == "" {
+				label = templateSizeLabel
+			}
+			sizeBox.AddItem3(label, qt6.NewQVariant11(size))
+		}
+		if index := sizeBox.FindData(qt6.NewQVariant11(picked)); index >= 0 {
+			sizeBox.SetCurrentIndex(index)
+		}
+		sizeBox.SetVisible(selected && len(sizes) > 1)
+	}
 
-				// Check if the node the VM is on is the same one as we're logging into
-				if strings.Compare(specifiedNode.Server, vm.Node) != 0 {
-					// Get the network of the first node
-					originalNodeAddrs, err := getNodeAddresses(creds, token)
-					if err != nil {
-						statusLabel.SetText(fmt.Sprintf("Error: %s\n", err))
-						log.Fatalf("Error while getting the IP addresses for Node %s: %+v\n", creds.Server, err)
-					}
+	// Hide everything the search doesn't match, along with any groups left empty
+	applySearch := func() {
+		for groupIndex := 0; groupIndex < desktopTree.TopLevelItemCount(); groupIndex++ {
+			group := desktopTree.TopLevelItem(groupIndex)
 
-					// Try to find the original IP that we were given for the original node
-					var network netip.Prefix
-					for _, addr := range originalNodeAddrs {
-						if strings.Compare(addr.Address, creds.Address) == 0 {
-							network = netip.MustParsePrefix(addr.Cidr)
-						}
-					}
+			visible := 0
+			for childIndex := 0; childIndex < group.ChildCount(); childIndex++ {
+				child := group.Child(childIndex)
+				desktop, _ := itemDesktop(child)
 
-					// Now get the new node's addresses
-					specifiedNode.Server = vm.Node
-					newNodeAddrs, err := getNodeAddresses(specifiedNode, token)
-					if err != nil {
-						statusLabel.SetText(fmt.Sprintf("Error: %s\n", err))
-						log.Fatalf("Error while getting the IP addresses for Node %s: %+v\n", specifiedNode.Server, err)
-					}
+				matches := desktop.Matches(searchBox.Text())
+				child.SetHidden(!matches)
+				if matches {
+					visible++
+				}
+			}
 
-					// Compare each of the new node's addresses and see if they are in the original node's network
-					for _, addr := range newNodeAddrs {
-						if strings.Compare(addr.Address, "") != 0 && network.Contains(netip.MustParseAddr(addr.Address)) {
-							specifiedNode.Address = addr.Address
-						}
-					}
+			group.SetHidden(visible == 0)
+		}
+	}
 
-					specifiedToken, err = connectToProxmox(specifiedNode)
-					if err != nil {
-						statusLabel.SetText(fmt.Sprintf("Error: %s\n", err))
-						log.Fatalf("Error while connecting to the node %s: %+v\n", specifiedNode.Server, err)
-					}
-				} else {
-					specifiedToken = token
-				}
+	// firstVisibleDesktop is where the keyboard goes when leaving the search box
+	firstVisibleDesktop := func() *qt6.QTreeWidgetItem {
+		for groupIndex := 0; groupIndex < desktopTree.TopLevelItemCount(); groupIndex++ {
+			group := desktopTree.TopLevelItem(groupIndex)
+			if group.IsHidden() {
+				continue
+			}
 
-				clonedVm, job, err := cloneTemplate(specifiedNode, specifiedToken, vm)
-				if err != nil {
-					statusLabel.SetText(fmt.Sprintf("Error: %v\n", err))
-					log.Fatalf("Error while cloning VM: %v\n", err)
-				}
-				fmt.Printf("Sent clone VM Job\n")
-
-				for status, err := getJobStatus(specifiedNode, specifiedToken, job); err == nil && !(strings.Compare(status.Status, "stopped") == 0); status, err = getJobStatus(specifiedNode, specifiedToken, job) {
-					fmt.Printf("Status: %s\n", status)
-					statusLabel.SetText("Status: Cloning")
-					statusLabel.Show()
-					connectingLayout.AddWidget(statusLabel.QWidget)
-					connectingLayout.AddSpacing(statusLabel.Height())
-				}
-				if err != nil {
-					statusLabel.SetText(fmt.Sprintf("Error: %v\n", err))
-					log.Fatalf("Error while getting job status: %v\n", err)
+			for childIndex := 0; childIndex < group.ChildCount(); childIndex++ {
+				if child := group.Child(childIndex); !child.IsHidden() {
+					return child
 				}
+			}
+		}
 
-				err = startVM(creds, token, clonedVm)
-				if err != nil {
-					return
-				}
-				fmt.Printf("Starting VM")
-
-				// Create the status label for the child window
-				for status, err := getVmHealth(specifiedNode, specifiedToken, clonedVm); err == nil && !(strings.Contains(status, "200 OK")); status, err = getVmHealth(specifiedNode, specifiedToken, clonedVm) {
-					fmt.Printf("Status: %s\n", status)
-					statusLabel.SetText("Status: Starting")
-					statusLabel.Show()
-					connectingLayout.AddWidget(statusLabel.QWidget)
-					connectingLayout.AddSpacing(statusLabel.Height())
+		return nil
+	}
+
+	populate := func(list []Desktop) {
+		lastList = list
+
+		// Keep whatever the user had selected selected
+		selectedId := ""
+		if desktop, exists := itemDesktop(desktopTree.CurrentItem()); exists {
+			selectedId = desktop.Vm.Id
+		}
+
+		desktopTree.Clear()
+		clear(desktops)
+
+		// Favourites come first, then everything else by group name
+		groupNames := make([]string, 0)
+		grouped := make(map[string][]Desktop)
+		for _, desktop := range list {
+			group := desktop.Group()
+			if favourites[desktop.Vm.Name] {
+				group = favouritesGroup
+			}
+
+			if _, exists := grouped[group]; !exists {
+				groupNames = append(groupNames, group)
+			}
+			grouped[group] = append(grouped[group], desktop)
+		}
+		slices.SortFunc(groupNames, func(a string, b string) int {
+			if strings.Compare(a, favouritesGroup) == 0 {
+				return -1
+			} else if strings.Compare(b, favouritesGroup) == 0 {
+				return 1
+			}
+			return strings.Compare(a, b)
+		})
+
+		var selectedItem *qt6.QTreeWidgetItem
+		for _, groupName := range groupNames {
+			groupItem := qt6.NewQTreeWidgetItem()
+			groupItem.SetText(desktopColumnName, groupName)
+			groupItem.SetFlags(qt6.ItemIsEnabled)
+			groupItem.SetFirstColumnSpanned(true)
+			desktopTree.AddTopLevelItem(groupItem)
+
+			for _, desktop := range grouped[groupName] {
+				item := qt6.NewQTreeWidgetItem()
+				item.SetText(desktopColumnName, desktop.Vm.Name)
+				item.SetIcon(desktopColumnName, osIcon(desktop.OsFamily()))
+				item.SetText(desktopColumnStatus, desktop.StatusText())
+				item.SetText(desktopColumnNode, desktop.Vm.Node)
+				item.SetText(desktopColumnCpu, desktop.CpuText())
+				item.SetText(desktopColumnMemory, desktop.MemoryText())
+				item.SetText(desktopColumnSession, desktop.SessionText())
+				item.SetData(desktopColumnName, int(qt6.UserRole), qt6.NewQVariant11(desktop.Vm.Id))
+
+				// Desktops on nodes that are down stay visible so the user knows why they can't have them
+				if !desktop.Available() {
+					item.SetText(desktopColumnName, fmt.Sprintf("%s (unavailable)", desktop.Vm.Name))
+					item.SetToolTip(desktopColumnName, fmt.Sprintf("%s is unavailable: %s", desktop.Vm.Name, desktop.NodeState.Reason()))
+					item.SetDisabled(true)
 				}
-				if err != nil {
-					statusLabel.SetText(fmt.Sprintf("Error: %v\n", err))
-					log.Fatalf("Error while getting job status: %v\n", err)
+
+				desktops[desktop.Vm.Id] = desktop
+				groupItem.AddChild(item)
+
+				if strings.Compare(desktop.Vm.Id, selectedId) == 0 {
+					selectedItem = item
 				}
+			}
+		}
 
-				statusLabel.SetText("Started!")
+		desktopTree.ExpandAll()
+		for column := desktopColumnName; column <= desktopColumnSession; column++ {
+			desktopTree.ResizeColumnToContents(column)
+		}
 
-				// Log in with the required node's credentials
-				err = connectToSpice(specifiedNode, specifiedToken, clonedVm)
+		applySearch()
+		if selectedItem != nil {
+			desktopTree.SetCurrentItem(selectedItem)
+		}
+		updateButtons()
+	}
 
-				if err != nil {
-					statusLabel.SetText(fmt.Sprintf("Couldn't connect to VM: %s\n", err))
-				}
+	connectSelected := func() {
+		desktop, selected := selectedDesktop()
+		if !selected {
+			return
+		}
 
-				// Create USB redirect rules
-				//redirectRules := make([]string, 0)
+		size := ""
+		if sizeBox.Count() > 0 {
+			size = sizeBox.CurrentData().ToString()
+		}
 
-				// Block USB HID devices
-				//redirectRules = append(redirectRules, "0x03,-1,-1,-1,0")
+		fmt.Printf("Connecting to %s\n", desktop.Vm.Name)
+		connect(desktop.Vm, size)
+	}
 
-				// Block USB Hubs
-				//redirectRules = append(redirectRules, "0x09,-1,-1,-1,0")
+	toggleFavourite := func() {
+		desktop, exists := itemDesktop(desktopTree.CurrentItem())
+		if !exists {
+			return
+		}
 
-				// Allow all USB devices
-				//redirectRules = append(redirectRules, "-1,-1,-1,-1,1")
+		if favourites[desktop.Vm.Name] {
+			delete(favourites, desktop.Vm.Name)
+		} else {
+			favourites[desktop.Vm.Name] = true
+		}
 
-				// Kiosk Mode
-				vdiArgs := make([]string, 0)
+		err := saveFavourites(creds.Username, favourites)
+		if err != nil {
+			log.Printf("Couldn't save favourites: %+v\n", err)
+		}
+		populate(lastList)
+	}
 
-				// Redirect USB rules: Block any HID device from being redirected, allow everything else
-				//vdiArgs = append(vdiArgs, fmt.Sprintf("--spice-usbredir-auto-redirect-filter=%s", strings.Join(redirectRules, "|")))
+	desktopTree.OnCurrentItemChanged(func(current *qt6.QTreeWidgetItem, previous *qt6.QTreeWidgetItem) {
+		updateButtons()
+	})
+	desktopTree.OnItemActivated(func(item *qt6.QTreeWidgetItem, column int) {
+		connectSelected()
+	})
+	connectButton.OnClicked(connectSelected)
+	favouriteButton.OnClicked(toggleFavourite)
+
+	searchBox.OnTextChanged(func(string) {
+		applySearch()
+	})
+
+	// Enter in the search box connects to the best match, Down moves into the list
+	searchBox.OnReturnPressed(func() {
+		if item := firstVisibleDesktop(); item != nil {
+			desktopTree.SetCurrentItem(item)
+			connectSelected()
+		}
+	})
+	searchBox.OnKeyPressEvent(func(super func(event *qt6.QKeyEvent), event *qt6.QKeyEvent) {
+		if event.Key() != int(qt6.Key_Down) {
+			super(event)
+			return
+		}
 
-				// Kiosk mode - Don't allow user to configure anything
-				//vdiArgs = append(vdiArgs, "-k", "--kiosk-quit", "on-disconnect")
+		if item := firstVisibleDesktop(); item != nil {
+			desktopTree.SetCurrentItem(item)
+		}
+		desktopTree.SetFocus()
+	})
+
+	// The picker gets deleted when the user connects, refreshes still in flight by then have nowhere to go
+	destroyed := false
+	pickerWidget.OnDestroyed(func() {
+		destroyed = true
+	})
+
+	// Talking to PVE can be slow, so refreshes happen in the background
+	refreshing := false
+	var refresh func(interactive bool)
+	refresh = func(interactive bool) {
+		if refreshing {
+			return
+		}
+		refreshing = true
+		refreshButton.SetEnabled(false)
 
-				// Full screen, but allow user to configure
-				vdiArgs = append(vdiArgs, "-f")
+		// The ticket gets renewed behind our back, so always use the latest one
+		token := currentToken()
+		go func() {
+			resources, err := getAvailableVMList(creds, token)
 
-				vdiArgs = append(vdiArgs, os.Getenv("VDI_TEMPFILE_FILENAME"))
-				cmd := exec.Command("remote-viewer", vdiArgs...)
+			var list []Desktop
+			if err == nil {
+				list = listDesktops(creds, token, resources)
+			}
 
-				if errors.Is(cmd.Err, exec.ErrDot) {
-					cmd.Err = nil
+			mainthread.Start(func() {
+				if destroyed {
+					return
 				}
+				refreshing = false
+				refreshButton.SetEnabled(true)
 
-				if err := cmd.Run(); err != nil {
-					statusLabel.SetText(fmt.Sprintf("Couldn't connect to VM: %s\n", err))
-					log.Fatalf("Error while executing thin client profile: %+v\n", err)
-				}
+				if err != nil {
+					log.Printf("Error while refreshing the desktop list: %+v\n", err)
+					refreshLabel.SetText("Couldn't refresh the desktop list, will try again shortly")
 
-				// TODO: Remove VM
+					// Background refreshes fail quietly, no point nagging about every one
+					if interactive && showError(pickerWidget, "Couldn't refresh the desktop list", err) == errorRetry {
+						refresh(true)
+					}
+					return
+				}
 
-				qt6.QCoreApplication_Exit()
+				populate(list)
+				refreshLabel.SetText(fmt.Sprintf("Last updated %s", time.Now().Format(time.TimeOnly)))
 			})
+		}()
+	}
+	refreshButton.OnClicked(func() {
+		refresh(true)
+	})
+
+	// Keyboard shortcuts, these only apply while the picker is on screen
+	qt6.NewQShortcut2(qt6.NewQKeySequence2("Ctrl+F"), pickerWidget.QObject).OnActivated(func() {
+		searchBox.SetFocus()
+		searchBox.SelectAll()
+	})
+	qt6.NewQShortcut2(qt6.NewQKeySequence2("Ctrl+D"), pickerWidget.QObject).OnActivated(toggleFavourite)
+	qt6.NewQShortcut2(qt6.NewQKeySequence2("F5"), pickerWidget.QObject).OnActivated(func() {
+		refresh(true)
+	})
+
+	// The timer belongs to the picker, so it goes away along with it
+	refreshTimer := qt6.NewQTimer2(pickerWidget.QObject)
+	refreshTimer.OnTimeout(func() {
+		refresh(false)
+	})
+	refreshTimer.Start(int(config.RefreshInterval.Milliseconds()))
+
+	// Show what we've got straight away without waiting on PVE, the refresh fills in the rest. vms may be stale by
+	// the time we come back from a session though
+	populate(listCachedDesktops(creds.Username, vms))
+	refresh(false)
+	searchBox.SetFocus()
+
+	return pickerWidget
+}
 
-			// Add the button to the layout
-			vmButton.SetFixedWidth(320)
-			mainWindowLayout.AddWidget(vmButton.QWidget)
+// buildConnecting creates the screen shown while a desktop is prepared, and kicks off the connection in the
+// background. back is called to return to the picker once the user cancels, retry to start over after an error and
+// ended once the session is over and the desktop cleaned up
+func buildConnecting(vm ProxmoxVm, size string, creds ProxmoxCreds, token ProxmoxAuth, router *NodeRouter, back func(), retry func(), ended func()) *qt6.QWidget {
+	connectingLayout := qt6.NewQVBoxLayout2()
+
+	// Set connecting container widget settings
+	connectingWidget := qt6.NewQWidget2()
+	connectingWidget.SetWindowTitle(fmt.Sprintf("Connecting to %s", vm.Name))
+	connectingWidget.SetLayout(connectingLayout.QLayout)
+
+	// Build the layout for the child window
+	statusLabel := qt6.NewQLabel2()
+	vmNameLabel := qt6.NewQLabel2()
+
+	// Create the VM Name label
+	vmNameLabel.SetText(fmt.Sprintf("Virtual desktop chosen: %s\n", vm.Name))
+	connectingLayout.AddWidget(vmNameLabel.QWidget)
+	connectingLayout.AddSpacing(vmNameLabel.Height())
+
+	connectingLayout.AddWidget(statusLabel.QWidget)
+	connectingLayout.AddSpacing(statusLabel.Height())
+
+	// Progress comes straight from the PVE task log, tasks that don't report any get a busy indicator instead
+	progressBar := qt6.NewQProgressBar2()
+	progressBar.SetRange(0, 0)
+	connectingLayout.AddWidget(progressBar.QWidget)
+
+	// The raw task log is tucked away for when something needs troubleshooting
+	detailsButton := qt6.NewQPushButton3("Show details")
+	detailsButton.SetCheckable(true)
+	detailsLog := qt6.NewQPlainTextEdit2()
+	detailsLog.SetReadOnly(true)
+	detailsLog.Hide()
+	detailsButton.OnToggled(func(checked bool) {
+		detailsLog.SetVisible(checked)
+		if checked {
+			detailsButton.SetText("Hide details")
+		} else {
+			detailsButton.SetText("Show details")
 		}
-	}
+	})
+	connectingLayout.AddWidget(detailsButton.QWidget)
+	connectingLayout.AddWidget(detailsLog.QWidget)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Cancelling tears down the clone in the background, we go back to the list once that's finished
+	cancelButton := qt6.NewQPushButton3("Cancel")
+	cancelButton.OnClicked(func() {
+		cancelButton.SetEnabled(false)
+		statusLabel.SetText("Status: Cancelling")
+		cancel()
+	})
+	connectingLayout.AddWidget(cancelButton.QWidget)
+
+	// The connection takes minutes, so run it in the background and marshal updates back to the Qt thread
+	go func() {
+		defer cancel()
+
+		err := connectToDesktop(ctx, creds, token, router, vm, size, ConnectProgress{
+			Status: func(status string) {
+				mainthread.Start(func() {
+					statusLabel.SetText(fmt.Sprintf("Status: %s", status))
+
+					// There's nothing left to cancel once the viewer is up
+					if strings.Compare(status, "Connected") == 0 {
+						cancelButton.Hide()
+						progressBar.Hide()
+					}
+				})
+			},
+			Percent: func(percent int) {
+				mainthread.Start(func() {
+					if percent < 0 {
+						progressBar.SetRange(0, 0)
+					} else {
+						progressBar.SetRange(0, 100)
+						progressBar.SetValue(percent)
+					}
+				})
+			},
+			Log: func(line string) {
+				mainthread.Start(func() {
+					detailsLog.AppendPlainText(line)
+				})
+			},
+		})
+
+		// Only go back to the list if it was the user that cancelled, timeouts are errors like any other
+		userCancelled := errors.Is(err, context.Canceled) && ctx.Err() != nil
+
+		mainthread.Start(func() {
+			if userCancelled {
+				back()
+				return
+			} else if err != nil {
+				log.Printf("Error while connecting to %s: %+v\n", vm.Name, err)
+				statusLabel.SetText(fmt.Sprintf("Status: Couldn't connect to %s", vm.Name))
+				cancelButton.Hide()
+				progressBar.Hide()
+
+				if showError(connectingWidget, fmt.Sprintf("Couldn't connect to %s", vm.Name), err) == errorRetry {
+					retry()
+				} else {
+					back()
+				}
+				return
+			}
 
-	// Show the window
-	homeWidget.SetCentralWidget(testWidget)
-	homeWidget.Show()
-	qt6.QApplication_Exec()
+			ended()
+		})
+	}()
+
+	return connectingWidget
+}
+
+// How long the session ended screen stays up before going back to the list on its own
+const sessionEndedDelay = 5 * time.Second
+
+// buildSessionEnded lets the user know their desktop has gone, then calls back to return to the list
+func buildSessionEnded(vm ProxmoxVm, back func()) *qt6.QWidget {
+	endedLayout := qt6.NewQVBoxLayout2()
+
+	endedWidget := qt6.NewQWidget2()
+	endedWidget.SetLayout(endedLayout.QLayout)
+
+	endedLabel := qt6.NewQLabel3("Your session has ended")
+	endedLayout.AddWidget(endedLabel.QWidget)
+
+	detailLabel := qt6.NewQLabel3(fmt.Sprintf("%s has been closed.", vm.Name))
+	endedLayout.AddWidget(detailLabel.QWidget)
+
+	backButton := qt6.NewQPushButton3("Back to desktops")
+	backButton.OnClicked(back)
+	endedLayout.AddWidget(backButton.QWidget)
+
+	// Go back by ourselves too, the next person at a thin client shouldn't have to. The timer is owned by the
+	// widget, so it can't fire once the user's already gone back
+	backTimer := qt6.NewQTimer2(endedWidget.QObject)
+	backTimer.SetSingleShot(true)
+	backTimer.OnTimeout(back)
+	backTimer.Start(int(sessionEndedDelay.Milliseconds()))
+
+	return endedWidget
 }
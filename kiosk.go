@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/mappu/miqt/qt6"
+	"github.com/mappu/miqt/qt6/mainthread"
+)
+
+type KioskConfig struct {
+	// Run as a locked down thin client, the same as passing --kiosk
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Sign the user out after this long without any keyboard or mouse input on the desktop list
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+
+	// Key combination that brings up the admin PIN prompt
+	UnlockShortcut string `json:"unlock_shortcut,omitempty"`
+
+	// SHA-256 of the admin PIN, hex encoded. Leaving it empty means the kiosk can't be unlocked at all
+	AdminPinSha256 string `json:"admin_pin_sha256,omitempty"`
+
+	// Realm added to usernames typed in without one
+	Realm string `json:"realm,omitempty"`
+}
+
+// lockWindow makes window fill the screen with no way for the user to close it. The admin unlock shortcut is the
+// only way out, and it quits the client altogether
+func lockWindow(window *qt6.QMainWindow) {
+	unlocked := false
+
+	window.SetWindowFlags(qt6.FramelessWindowHint)
+	window.OnCloseEvent(func(super func(event *qt6.QCloseEvent), event *qt6.QCloseEvent) {
+		if !unlocked {
+			event.Ignore()
+			return
+		}
+		super(event)
+	})
+
+	unlockShortcut := qt6.NewQShortcut2(qt6.NewQKeySequence2(config.Kiosk.UnlockShortcut), window.QObject)
+	unlockShortcut.SetContext(qt6.ApplicationShortcut)
+	unlockShortcut.OnActivated(func() {
+		if config.Kiosk.AdminPinSha256 == "" {
+			log.Printf("Kiosk unlock requested but no admin PIN is configured\n")
+			return
+		}
+
+		ok := false
+		pin := qt6.QInputDialog_GetText4(window.QWidget, "Administrator", "Enter the admin PIN", qt6.QLineEdit__Password, "", &ok)
+		if !ok {
+			return
+		}
+
+		if !checkAdminPin(pin) {
+			log.Printf("Incorrect admin PIN entered\n")
+			return
+		}
+
+		log.Printf("Kiosk unlocked by administrator\n")
+		unlocked = true
+		qt6.QCoreApplication_Exit()
+	})
+
+	window.ShowFullScreen()
+}
+
+func checkAdminPin(pin string) bool {
+	expected, err := hex.DecodeString(strings.TrimSpace(config.Kiosk.AdminPinSha256))
+	if err != nil {
+		log.Printf("admin_pin_sha256 isn't valid hex: %+v\n", err)
+		return false
+	}
+
+	actual := sha256.Sum256([]byte(pin))
+	return subtle.ConstantTimeCompare(actual[:], expected) == 1
+}
+
+// IdleWatcher calls onIdle once there's been no keyboard or mouse input anywhere in the app for the idle timeout.
+// It only counts while started, so a session running in the viewer doesn't get the user signed out
+type IdleWatcher struct {
+	timer   *qt6.QTimer
+	started bool
+}
+
+func newIdleWatcher(onIdle func()) *IdleWatcher {
+	watcher := &IdleWatcher{timer: qt6.NewQTimer()}
+	watcher.timer.SetSingleShot(true)
+	watcher.timer.OnTimeout(func() {
+		watcher.started = false
+		onIdle()
+	})
+
+	// Watch input going to every widget, not just whichever one has focus
+	filter := qt6.NewQObject()
+	filter.OnEventFilter(func(super func(watched *qt6.QObject, event *qt6.QEvent) bool, watched *qt6.QObject, event *qt6.QEvent) bool {
+		switch event.Type() {
+		case qt6.QEvent__KeyPress, qt6.QEvent__MouseButtonPress, qt6.QEvent__MouseMove, qt6.QEvent__Wheel, qt6.QEvent__TouchBegin:
+			if watcher.started {
+				watcher.timer.Start(int(config.Kiosk.IdleTimeout.Milliseconds()))
+			}
+		}
+		return super(watched, event)
+	})
+	qt6.QCoreApplication_Instance().InstallEventFilter(filter)
+
+	return watcher
+}
+
+func (watcher *IdleWatcher) Start() {
+	watcher.started = true
+	watcher.timer.Start(int(config.Kiosk.IdleTimeout.Milliseconds()))
+}
+
+func (watcher *IdleWatcher) Stop() {
+	watcher.started = false
+	watcher.timer.Stop()
+}
+
+// buildLogin creates the kiosk sign in screen. creds supplies the server to sign in to, signedIn is called with the
+// user's own credentials once PVE accepts them
+func buildLogin(creds ProxmoxCreds, signedIn func(userCreds ProxmoxCreds, token ProxmoxAuth, vms ProxmoxVmList)) *qt6.QWidget {
+	loginLayout := qt6.NewQVBoxLayout2()
+
+	loginWidget := qt6.NewQWidget2()
+	loginWidget.SetLayout(loginLayout.QLayout)
+
+	header := qt6.NewQLabel3("Sign in to get a desktop")
+	loginLayout.AddWidget(header.QWidget)
+	loginLayout.AddSpacing(header.Height())
+
+	usernameBox := qt6.NewQLineEdit2()
+	usernameBox.SetPlaceholderText("Username")
+	loginLayout.AddWidget(usernameBox.QWidget)
+
+	passwordBox := qt6.NewQLineEdit2()
+	passwordBox.SetPlaceholderText("Password")
+	passwordBox.SetEchoMode(qt6.QLineEdit__Password)
+	loginLayout.AddWidget(passwordBox.QWidget)
+
+	statusLabel := qt6.NewQLabel2()
+	loginLayout.AddWidget(statusLabel.QWidget)
+
+	signInButton := qt6.NewQPushButton3("Sign in")
+	signInButton.SetDefault(true)
+	loginLayout.AddWidget(signInButton.QWidget)
+	loginLayout.AddStretch()
+
+	destroyed := false
+	loginWidget.OnDestroyed(func() {
+		destroyed = true
+	})
+
+	var signIn func()
+	signIn = func() {
+		if usernameBox.Text() == "" {
+			usernameBox.SetFocus()
+			return
+		}
+
+		userCreds := creds
+		userCreds.Username = usernameBox.Text()
+		userCreds.Password = passwordBox.Text()
+		if !strings.Contains(userCreds.Username, "@") {
+			userCreds.Username = fmt.Sprintf("%s@%s", userCreds.Username, config.Kiosk.Realm)
+		}
+
+		signInButton.SetEnabled(false)
+		statusLabel.SetText("Signing in")
+
+		go func() {
+			token, err := connectToProxmox(userCreds)
+
+			var vms ProxmoxVmList
+			if err == nil {
+				vms, err = getAvailableVMList(userCreds, token)
+			}
+
+			mainthread.Start(func() {
+				if destroyed {
+					return
+				}
+
+				signInButton.SetEnabled(true)
+
+				if errors.Is(err, errLoginFailed) {
+					statusLabel.SetText("Incorrect username or password")
+					passwordBox.Clear()
+					passwordBox.SetFocus()
+					return
+				} else if err != nil {
+					log.Printf("Error while signing in as %s: %+v\n", userCreds.Username, err)
+					statusLabel.SetText("")
+					if showError(loginWidget, "Couldn't sign in", err) == errorRetry {
+						signIn()
+					}
+					return
+				}
+
+				// Don't leave the password lying about for the next person
+				passwordBox.Clear()
+				signedIn(userCreds, token, vms)
+			})
+		}()
+	}
+
+	usernameBox.OnReturnPressed(func() {
+		passwordBox.SetFocus()
+	})
+	passwordBox.OnReturnPressed(signIn)
+	signInButton.OnClicked(signIn)
+	usernameBox.SetFocus()
+
+	return loginWidget
+}
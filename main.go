@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/tls"
+	"flag"
 	"log"
 	"net/http"
 	"os"
@@ -30,18 +31,48 @@ func main() {
 		}
 	}
 
+	kiosk := flag.Bool("kiosk", false, "run as a locked down thin client")
+	flag.Parse()
+
+	var err error
+	config, err = loadConfig()
+	if err != nil {
+		log.Fatalf("Error while loading configuration: %+v\n", err)
+	}
+	if *kiosk {
+		config.Kiosk.Enabled = true
+	}
+
 	creds, err := login()
 	if err != nil {
 		log.Fatalf("Error while getting Proxmox credentials: %+v\n", err)
 	}
+
+	// Kiosk users sign in themselves, creds.json just says where
+	if config.Kiosk.Enabled && flag.Arg(0) != "rebalance" {
+		buildWindow(ProxmoxVmList{}, creds, ProxmoxAuth{}, nil)
+		return
+	}
+
 	token, err := connectToProxmox(creds)
 	if err != nil {
 		log.Fatalf("Error while logging into Proxmox: %+v\n", err)
 	}
+
+	if flag.Arg(0) == "rebalance" {
+		err = rebalanceCommand(flag.Args()[1:], creds, token)
+		if err != nil {
+			log.Fatalf("Error while rebalancing desktops: %+v\n", err)
+		}
+		return
+	}
+
 	vms, err := getAvailableVMList(creds, token)
 	if err != nil {
 		log.Fatalf("Error while getting available VMs: %+v\n", err)
 	}
 
-	buildWindow(vms, creds, token)
+	router := newNodeRouter(creds, token)
+
+	buildWindow(vms, creds, token, router)
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+const (
+	// The guest resizes its screen to match the viewer window
+	ResolutionFit = "fit"
+
+	// The guest keeps its own resolution and the viewer scales it
+	ResolutionFixed = "fixed"
+)
+
+// PVE's qxl display goes up to qxl4
+const maxDisplays = 4
+
+type MonitorConfig struct {
+	// How many displays each desktop gets, up to 4. Zero leaves the template's display as it is
+	Displays int `json:"displays,omitempty"`
+
+	// Which of this client's monitors each display goes on, numbered from 1. Defaults to the first Displays monitors
+	Use []int `json:"use,omitempty"`
+
+	// How the guest's resolution is picked, see the Resolution* constants. Empty leaves it up to the viewer
+	Resolution string `json:"resolution,omitempty"`
+}
+
+func validateMonitorConfig(settings *MonitorConfig) error {
+	if settings.Displays == 0 {
+		settings.Displays = len(settings.Use)
+	}
+
+	if settings.Displays < 0 || settings.Displays > maxDisplays {
+		return fmt.Errorf("displays must be between 0 and %d\n", maxDisplays)
+	}
+
+	if len(settings.Use) > 0 && len(settings.Use) != settings.Displays {
+		return fmt.Errorf("use lists %d monitors for %d displays\n", len(settings.Use), settings.Displays)
+	}
+	for _, monitor := range settings.Use {
+		if monitor < 1 {
+			return fmt.Errorf("monitors are numbered from 1, not %d\n", monitor)
+		}
+	}
+
+	switch settings.Resolution {
+	case "", ResolutionFit, ResolutionFixed:
+	default:
+		return fmt.Errorf("unknown resolution %s\n", settings.Resolution)
+	}
+
+	return nil
+}
+
+// Mapping renders which client monitor each guest display goes on, in the .vv file's "display:monitor;..." syntax
+func (settings MonitorConfig) Mapping() string {
+	mapping := make([]string, 0, settings.Displays)
+
+	for display := 1; display <= settings.Displays; display++ {
+		monitor := display
+		if len(settings.Use) >= display {
+			monitor = settings.Use[display-1]
+		}
+		mapping = append(mapping, fmt.Sprintf("%d:%d", display, monitor))
+	}
+
+	return strings.Join(mapping, ";")
+}
+
+// ViewerArgs renders the resolution policy as remote-viewer command line options
+func (settings MonitorConfig) ViewerArgs() []string {
+	switch settings.Resolution {
+	case ResolutionFit:
+		return []string{"--auto-resize=always"}
+	case ResolutionFixed:
+		return []string{"--auto-resize=never"}
+	default:
+		return nil
+	}
+}
+
+// qxlDisplayType is the vga type giving a desktop that many displays, qxl for one and qxl2 to qxl4 for more
+func qxlDisplayType(displays int) string {
+	if displays <= 1 {
+		return "qxl"
+	}
+
+	return fmt.Sprintf("qxl%d", displays)
+}
+
+// configureDisplays gives the clone as many qxl heads as the client wants displays. It has to happen before the
+// clone starts, and only applies to desktops we'll be showing over SPICE
+func configureDisplays(creds ProxmoxCreds, token ProxmoxAuth, clone ProxmoxVm, template ProxmoxVm) error {
+	if config.Monitors.Displays == 0 {
+		return nil
+	}
+
+	vmConfig, err := getVmConfig(creds, token, clone)
+	if err != nil {
+		return fmt.Errorf("error while reading the clone's config: %w\n", err)
+	}
+
+	if strings.Compare(sessionProtocol(template, vmConfig), ProtocolSpice) != 0 {
+		log.Printf("Not setting up %d displays for %d, it isn't shown over SPICE\n", config.Monitors.Displays, clone.VmNumber)
+		return nil
+	}
+
+	wanted := qxlDisplayType(config.Monitors.Displays)
+	if strings.Compare(displayType(vmConfig), wanted) == 0 {
+		return nil
+	}
+
+	// Keep the rest of the display options, such as memory, and only swap the type
+	options := []string{wanted}
+	for _, option := range strings.Split(vmConfig.Get("vga"), ",") {
+		if strings.Contains(option, "=") && !strings.HasPrefix(option, "type=") {
+			options = append(options, option)
+		}
+	}
+
+	log.Printf("Switching %d's display from %s to %s\n", clone.VmNumber, displayType(vmConfig), wanted)
+
+	data := url.Values{}
+	data.Set("vga", strings.Join(options, ","))
+	return setVmConfig(creds, token, clone, data)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ProxmoxClusterStatus struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Ip     string `json:"ip"`
+	Online int    `json:"online"`
+	Local  int    `json:"local"`
+}
+
+type ProxmoxCorosyncNode struct {
+	Name      string `json:"name"`
+	Ring0Addr string `json:"ring0_addr"`
+	Ring1Addr string `json:"ring1_addr"`
+}
+
+type rawProxmoxClusterStatus struct {
+	Data []ProxmoxClusterStatus `json:"data"`
+}
+
+type rawProxmoxCorosyncNodes struct {
+	Data []ProxmoxCorosyncNode `json:"data"`
+}
+
+// NodeRouter works out which address the client should use to talk to each node in the cluster
+type NodeRouter struct {
+	creds ProxmoxCreds
+	token ProxmoxAuth
+
+	// Guards token, addresses and networks. It's never held while talking to the network, so one slow node doesn't
+	// hold up lookups for the others
+	lock      sync.Mutex
+	addresses map[string]string
+
+	// Only set once a lookup actually finds something, so a failed one is tried again next time
+	networksFound bool
+	networks      []netip.Prefix
+}
+
+const nodeProbeTimeout = 2 * time.Second
+
+func newNodeRouter(creds ProxmoxCreds, token ProxmoxAuth) *NodeRouter {
+	return &NodeRouter{
+		creds:     creds,
+		token:     token,
+		addresses: make(map[string]string),
+	}
+}
+
+// Resolve returns a reachable address for node, using the cached answer if we already have one
+func (router *NodeRouter) Resolve(node string) (string, error) {
+	router.lock.Lock()
+	address, exists := router.addresses[node]
+	token := router.token
+	router.lock.Unlock()
+
+	if exists {
+		return address, nil
+	}
+
+	// Two callers resolving the same node at once both do the work, which is harmless
+	address, err := router.discover(node, token)
+	if err != nil {
+		return "", err
+	}
+
+	router.lock.Lock()
+	defer router.lock.Unlock()
+
+	router.addresses[node] = address
+	return address, nil
+}
+
+// discover works out an address for node from scratch
+func (router *NodeRouter) discover(node string, token ProxmoxAuth) (string, error) {
+	// Config overrides are trusted as-is, the administrator knows better than we do
+	if address, exists := config.NodeAddresses[node]; exists && address != "" {
+		return address, nil
+	}
+
+	// The node we logged into is obviously reachable
+	if strings.Compare(node, router.creds.Server) == 0 {
+		return router.creds.Address, nil
+	}
+
+	candidates := router.candidates(node, token)
+	for _, candidate := range candidates {
+		if probeNodeAddress(candidate) {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("unable to find a reachable address for node %s, tried %s\n", node, strings.Join(candidates, ", "))
+}
+
+// SetToken swaps in a renewed ticket for discovering addresses with
+func (router *NodeRouter) SetToken(token ProxmoxAuth) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+
+	router.token = token
+}
+
+// SpiceProxy returns the address the SPICE client should use as its proxy for a VM running on node
+func (router *NodeRouter) SpiceProxy(node string) (string, error) {
+	switch config.SpiceProxyMode {
+	case SpiceProxyDedicated:
+		return config.SpiceProxy, nil
+	case SpiceProxyDirect:
+		return router.Resolve(node)
+	default:
+		// pveproxy on the node we're talking to forwards SPICE to whichever node the VM is on
+		return router.creds.Address, nil
+	}
+}
+
+// Forget drops the cached address for node so that the next Resolve discovers it again
+func (router *NodeRouter) Forget(node string) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+
+	delete(router.addresses, node)
+}
+
+// candidates gathers every address we know of for node, addresses in the same network as the API node first
+func (router *NodeRouter) candidates(node string, token ProxmoxAuth) []string {
+	found := make([]string, 0)
+
+	clusterStatus, err := getClusterStatus(router.creds, token)
+	if err != nil {
+		log.Printf("Couldn't get cluster status while resolving node %s: %+v\n", node, err)
+	}
+	for _, entry := range clusterStatus {
+		if strings.Compare(entry.Type, "node") == 0 && strings.Compare(entry.Name, node) == 0 {
+			found = append(found, entry.Ip)
+		}
+	}
+
+	corosyncNodes, err := getCorosyncNodes(router.creds, token)
+	if err != nil {
+		log.Printf("Couldn't get corosync configuration while resolving node %s: %+v\n", node, err)
+	}
+	for _, entry := range corosyncNodes {
+		if strings.Compare(entry.Name, node) == 0 {
+			found = append(found, entry.Ring0Addr, entry.Ring1Addr)
+		}
+	}
+
+	nodeCreds := router.creds
+	nodeCreds.Server = node
+	interfaces, err := getNodeAddresses(nodeCreds, token)
+	if err != nil {
+		log.Printf("Couldn't get network interfaces for node %s: %+v\n", node, err)
+	}
+	for _, iface := range interfaces {
+		found = append(found, iface.Address)
+	}
+
+	// Fall back on DNS as a last resort
+	found = append(found, node)
+
+	candidates := make([]string, 0, len(found))
+	seen := make(map[string]bool)
+	for _, address := range found {
+		if address == "" || seen[address] {
+			continue
+		}
+		seen[address] = true
+		candidates = append(candidates, address)
+	}
+
+	// Prefer addresses that live in the same network as the one we originally connected to
+	networks := router.apiNetworks(token)
+	preferred := make([]string, 0, len(candidates))
+	others := make([]string, 0, len(candidates))
+	for _, address := range candidates {
+		if addressInNetworks(address, networks) {
+			preferred = append(preferred, address)
+		} else {
+			others = append(others, address)
+		}
+	}
+
+	return append(preferred, others...)
+}
+
+// apiNetworks finds the networks the API address lives in, looking them up until it gets an answer
+func (router *NodeRouter) apiNetworks(token ProxmoxAuth) []netip.Prefix {
+	router.lock.Lock()
+	found, networks := router.networksFound, router.networks
+	router.lock.Unlock()
+
+	if found {
+		return networks
+	}
+
+	networks = router.lookupApiNetworks(token)
+	if len(networks) > 0 {
+		router.lock.Lock()
+		router.networksFound, router.networks = true, networks
+		router.lock.Unlock()
+	}
+
+	return networks
+}
+
+func (router *NodeRouter) lookupApiNetworks(token ProxmoxAuth) []netip.Prefix {
+	networks := make([]netip.Prefix, 0)
+
+	interfaces, err := getNodeAddresses(router.creds, token)
+	if err != nil {
+		log.Printf("Couldn't get network interfaces for node %s: %+v\n", router.creds.Server, err)
+		return networks
+	}
+
+	for _, iface := range interfaces {
+		if strings.Compare(iface.Address, router.creds.Address) != 0 || iface.Cidr == "" {
+			continue
+		}
+
+		network, err := netip.ParsePrefix(iface.Cidr)
+		if err != nil {
+			log.Printf("Ignoring unparseable CIDR %s on interface %s: %+v\n", iface.Cidr, iface.Interface, err)
+			continue
+		}
+		networks = append(networks, network.Masked())
+	}
+
+	return networks
+}
+
+func addressInNetworks(address string, networks []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// probeNodeAddress checks whether the Proxmox API port answers on address
+func probeNodeAddress(address string) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, "8006"), nodeProbeTimeout)
+	if err != nil {
+		return false
+	}
+
+	err = conn.Close()
+	if err != nil {
+		log.Printf("error while closing probe connection to %s: %+v\n", address, err)
+	}
+
+	return true
+}
+
+func getClusterStatus(creds ProxmoxCreds, token ProxmoxAuth) ([]ProxmoxClusterStatus, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/cluster/status", creds.Address)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodGet, apiUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedResponse rawProxmoxClusterStatus
+	err = json.Unmarshal(response, &parsedResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshalling json: %+v\n", err)
+	}
+
+	return parsedResponse.Data, nil
+}
+
+func getCorosyncNodes(creds ProxmoxCreds, token ProxmoxAuth) ([]ProxmoxCorosyncNode, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/cluster/config/nodes", creds.Address)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodGet, apiUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedResponse rawProxmoxCorosyncNodes
+	err = json.Unmarshal(response, &parsedResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshalling json: %+v\n", err)
+	}
+
+	return parsedResponse.Data, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type NodeState struct {
+	Name        string
+	Online      bool
+	Maintenance bool
+}
+
+type ProxmoxHaStatus struct {
+	Type   string `json:"type"`
+	Node   string `json:"node"`
+	Status string `json:"status"`
+}
+
+type rawProxmoxHaStatus struct {
+	Data []ProxmoxHaStatus `json:"data"`
+}
+
+// Available reports whether desktops can be created on the node
+func (state NodeState) Available() bool {
+	return state.Online && !state.Maintenance
+}
+
+// Reason explains to the user why a node can't be used
+func (state NodeState) Reason() string {
+	if !state.Online {
+		return fmt.Sprintf("node %s is offline", state.Name)
+	} else if state.Maintenance {
+		return fmt.Sprintf("node %s is in maintenance mode", state.Name)
+	}
+
+	return ""
+}
+
+// getNodeStates combines node status from the resource list with HA maintenance mode
+func getNodeStates(creds ProxmoxCreds, token ProxmoxAuth, resources ProxmoxVmList) map[string]NodeState {
+	states := resourceNodeStates(resources)
+
+	// HA isn't necessarily set up, in which case nothing can be in maintenance mode anyway
+	haStatus, err := getHaStatus(creds, token)
+	if err != nil {
+		log.Printf("Couldn't get HA status, assuming no nodes are in maintenance: %+v\n", err)
+		return states
+	}
+
+	// Each node's local resource manager reports its state, such as "pve1 (maintenance mode)"
+	for _, entry := range haStatus {
+		if strings.Compare(entry.Type, "lrm") != 0 || !strings.Contains(entry.Status, "maintenance") {
+			continue
+		}
+
+		state := states[entry.Node]
+		state.Name = entry.Node
+		state.Maintenance = true
+		states[entry.Node] = state
+	}
+
+	return states
+}
+
+// resourceNodeStates is which nodes are online going by the resource list alone, without asking about maintenance
+func resourceNodeStates(resources ProxmoxVmList) map[string]NodeState {
+	states := make(map[string]NodeState)
+
+	for _, resource := range resources.Data {
+		if strings.Compare(resource.Type, "node") == 0 {
+			states[resource.Node] = NodeState{
+				Name:   resource.Node,
+				Online: strings.Compare(resource.Status, "online") == 0,
+			}
+		}
+	}
+
+	return states
+}
+
+// nodeAvailable looks a node up in states, treating nodes we know nothing about as unavailable
+func nodeAvailable(states map[string]NodeState, node string) bool {
+	state, exists := states[node]
+	return exists && state.Available()
+}
+
+// relocateDesktops returns the VMs to offer the user. Where the same template exists on several nodes, copies on
+// unavailable nodes are dropped in favour of ones that can actually be used
+func relocateDesktops(vms ProxmoxVmList, states map[string]NodeState) []ProxmoxVm {
+	availableNames := make(map[string]bool)
+	for _, vm := range vms.Data {
+		if strings.Contains(vm.Type, "qemu") && nodeAvailable(states, vm.Node) {
+			availableNames[vm.Name] = true
+		}
+	}
+
+	desktops := make([]ProxmoxVm, 0)
+	for _, vm := range vms.Data {
+		if !strings.Contains(vm.Type, "qemu") {
+			continue
+		}
+
+		if !nodeAvailable(states, vm.Node) && availableNames[vm.Name] {
+			continue
+		}
+
+		desktops = append(desktops, vm)
+	}
+
+	return desktops
+}
+
+func getHaStatus(creds ProxmoxCreds, token ProxmoxAuth) ([]ProxmoxHaStatus, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/cluster/ha/status/current", creds.Address)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodGet, apiUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedResponse rawProxmoxHaStatus
+	err = json.Unmarshal(response, &parsedResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshalling json: %+v\n", err)
+	}
+
+	return parsedResponse.Data, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	PlacementSameAsTemplate = "same-as-template"
+	PlacementLeastCpu       = "least-cpu"
+	PlacementLeastMemory    = "least-memory"
+	PlacementRoundRobin     = "round-robin"
+)
+
+// Matches the config keys of every disk a VM can have attached
+var diskKeyPattern = regexp.MustCompile(`^(ide|sata|scsi|virtio|efidisk|tpmstate)\d+$`)
+
+var roundRobinLock sync.Mutex
+var roundRobinCounter int
+
+func validPlacement(policy string) bool {
+	switch policy {
+	case PlacementSameAsTemplate, PlacementLeastCpu, PlacementLeastMemory, PlacementRoundRobin:
+		return true
+	default:
+		return false
+	}
+}
+
+// chooseCloneTarget picks the node a new clone of template should be created on
+func chooseCloneTarget(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, template ProxmoxVm) (string, error) {
+	templateCfg := templateConfig(template)
+	policy := templateCfg.Placement
+	if policy == "" {
+		policy = config.Placement
+	}
+
+	resources, err := getAvailableVMList(creds, token)
+	if err != nil {
+		return "", fmt.Errorf("error while getting cluster resources: %w\n", err)
+	}
+	if ctx.Err() != nil {
+		return "", context.Cause(ctx)
+	}
+
+	candidates, err := placementCandidates(ctx, creds, token, template, templateCfg, resources)
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no node is able to host a clone of %s\n", template.Name)
+	}
+
+	switch policy {
+	case PlacementLeastCpu:
+		return slices.MinFunc(candidates, func(a, b ProxmoxVm) int {
+			return cmp.Compare(a.Cpu, b.Cpu)
+		}).Node, nil
+	case PlacementLeastMemory:
+		return slices.MinFunc(candidates, func(a, b ProxmoxVm) int {
+			return cmp.Compare(memoryUsage(a), memoryUsage(b))
+		}).Node, nil
+	case PlacementRoundRobin:
+		roundRobinLock.Lock()
+		defer roundRobinLock.Unlock()
+
+		slices.SortFunc(candidates, func(a, b ProxmoxVm) int {
+			return strings.Compare(a.Node, b.Node)
+		})
+		target := candidates[roundRobinCounter%len(candidates)].Node
+		roundRobinCounter++
+		return target, nil
+	default:
+		for _, candidate := range candidates {
+			if strings.Compare(candidate.Node, template.Node) == 0 {
+				return template.Node, nil
+			}
+		}
+		return "", fmt.Errorf("node %s holding template %s can't take the clone\n", template.Node, template.Name)
+	}
+}
+
+// placementCandidates returns the node resources that are online and out of maintenance, allowed for the template, and able to see its storage
+func placementCandidates(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, template ProxmoxVm, templateCfg TemplateConfig, resources ProxmoxVmList) ([]ProxmoxVm, error) {
+	// Moving a clone off the template's node is only possible when the template's disks are on shared storage
+	templateShared, err := templateOnSharedStorage(creds, token, template, resources)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+
+	targetStorage := os.Getenv("PVE_VDI_STORAGE")
+	states := getNodeStates(creds, token, resources)
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+
+	candidates := make([]ProxmoxVm, 0)
+	for _, resource := range resources.Data {
+		if strings.Compare(resource.Type, "node") != 0 || !nodeAvailable(states, resource.Node) {
+			continue
+		}
+
+		if len(templateCfg.Nodes) > 0 && !slices.Contains(templateCfg.Nodes, resource.Node) {
+			continue
+		}
+
+		if strings.Compare(resource.Node, template.Node) != 0 && !templateShared {
+			continue
+		}
+
+		if targetStorage != "" && !storageAvailable(resources, resource.Node, targetStorage) {
+			continue
+		}
+
+		candidates = append(candidates, resource)
+	}
+
+	return candidates, nil
+}
+
+func templateOnSharedStorage(creds ProxmoxCreds, token ProxmoxAuth, template ProxmoxVm, resources ProxmoxVmList) (bool, error) {
+	vmConfig, err := getVmConfig(creds, token, template)
+	if err != nil {
+		return false, fmt.Errorf("error while getting config for template %s: %w\n", template.Name, err)
+	}
+
+	for _, storage := range diskStorages(vmConfig) {
+		if !storageShared(resources, template.Node, storage) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// diskStorages lists the storages a VM's disks are on, leaving out CD drives
+func diskStorages(vmConfig ProxmoxVmConfig) []string {
+	storages := make([]string, 0)
+
+	for key := range vmConfig {
+		if !diskKeyPattern.MatchString(key) {
+			continue
+		}
+
+		disk := vmConfig.Get(key)
+		if strings.Contains(disk, "media=cdrom") || strings.HasPrefix(disk, "none") {
+			continue
+		}
+
+		storage, _, found := strings.Cut(disk, ":")
+		if found && !slices.Contains(storages, storage) {
+			storages = append(storages, storage)
+		}
+	}
+
+	return storages
+}
+
+func storageShared(resources ProxmoxVmList, node string, storage string) bool {
+	for _, resource := range resources.Data {
+		if strings.Compare(resource.Type, "storage") == 0 && strings.Compare(resource.Node, node) == 0 && strings.Compare(resource.Storage, storage) == 0 {
+			return resource.Shared == 1
+		}
+	}
+
+	return false
+}
+
+func storageAvailable(resources ProxmoxVmList, node string, storage string) bool {
+	for _, resource := range resources.Data {
+		if strings.Compare(resource.Type, "storage") == 0 && strings.Compare(resource.Node, node) == 0 && strings.Compare(resource.Storage, storage) == 0 {
+			return strings.Compare(resource.Status, "available") == 0
+		}
+	}
+
+	return false
+}
+
+func memoryUsage(node ProxmoxVm) float64 {
+	if node.MaxMem == 0 {
+		return 1
+	}
+
+	return float64(node.Mem) / float64(node.MaxMem)
+}
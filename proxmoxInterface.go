@@ -2,15 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	rand2 "math/rand/v2"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 )
@@ -21,6 +26,29 @@ type ProxmoxJobStatus struct {
 	Status     string `json:"status"`
 }
 
+type ProxmoxTaskLogLine struct {
+	LineNumber int    `json:"n"`
+	Text       string `json:"t"`
+}
+
+type rawProxmoxTaskLog struct {
+	Data []ProxmoxTaskLogLine `json:"data"`
+}
+
+type ProxmoxGuestInterface struct {
+	Name        string `json:"name"`
+	IpAddresses []struct {
+		Address string `json:"ip-address"`
+		Type    string `json:"ip-address-type"`
+	} `json:"ip-addresses"`
+}
+
+type rawProxmoxGuestInterfaces struct {
+	Data struct {
+		Result []ProxmoxGuestInterface `json:"result"`
+	} `json:"data"`
+}
+
 type ProxmoxCreds struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -46,7 +74,27 @@ type ProxmoxVm struct {
 	Name     string `json:"name"`
 	Node     string `json:"node"`
 	Type     string `json:"type"`
-	VmNumber int32
+	VmNumber int32  `json:"vmid"`
+
+	// Usage metrics, filled in for both VMs and nodes
+	Cpu    float64 `json:"cpu"`
+	MaxCpu float64 `json:"maxcpu"`
+	Mem    int64   `json:"mem"`
+	MaxMem int64   `json:"maxmem"`
+
+	// Only set for storage resources
+	Storage string `json:"storage"`
+	Shared  int    `json:"shared"`
+
+	Template int    `json:"template"`
+	Tags     string `json:"tags"`
+	Pool     string `json:"pool"`
+}
+
+type ProxmoxVmConfig map[string]interface{}
+
+type rawProxmoxVmConfig struct {
+	Data ProxmoxVmConfig `json:"data"`
 }
 
 type rawProxmoxInterfaces struct {
@@ -111,53 +159,141 @@ func connectToProxmox(creds ProxmoxCreds) (ProxmoxAuth, error) {
 	data.Set("password", creds.Password)
 	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://%s:8006/api2/json/access/ticket", creds.Address), bytes.NewBufferString(data.Encode()))
 	if err != nil {
-		log.Fatalf("error while creating request: %+v\n", err)
+		return ProxmoxAuth{}, fmt.Errorf("error while creating request: %+v\n", err)
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("error while performing request: %+v\n", err)
+		return ProxmoxAuth{}, fmt.Errorf("error while performing request: %+v\n", err)
 	}
+	defer resp.Body.Close()
 
 	token, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalf("Error while parsing response: %+v\n", err)
+		return ProxmoxAuth{}, fmt.Errorf("error while parsing response: %+v\n", err)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ProxmoxAuth{}, errLoginFailed
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ProxmoxAuth{}, newProxmoxApiError(http.MethodPost, req.URL.String(), resp, token)
 	}
 
 	var parsedResponse ProxmoxAuth
 
 	err = json.Unmarshal(token, &parsedResponse)
 	if err != nil {
-		log.Fatalf("Error while unmarshalling response: %+v\n", err)
+		return ProxmoxAuth{}, fmt.Errorf("error while unmarshalling response: %+v\n", err)
+	}
+
+	// Older PVE versions answer a bad password with a 200 and no ticket
+	if parsedResponse.Data.Ticket == "" {
+		return ProxmoxAuth{}, errLoginFailed
 	}
 
 	return parsedResponse, nil
 }
 
-func getAvailableVMList(creds ProxmoxCreds, token ProxmoxAuth) (ProxmoxVmList, error) {
+// errLoginFailed means PVE didn't accept the username and password
+var errLoginFailed = errors.New("incorrect username or password")
+
+// proxmoxApiRequest performs an authenticated API call and returns the body of any 2xx response
+func proxmoxApiRequest(creds ProxmoxCreds, token ProxmoxAuth, method string, apiUrl string, data url.Values) ([]byte, error) {
 	authCookie := &http.Cookie{
 		Name:  "PVEAuthCookie",
 		Value: token.Data.Ticket,
 	}
 
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s:8006/api2/json/cluster/resources/", creds.Address), nil)
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewBufferString(data.Encode())
+	}
+
+	req, err := http.NewRequest(method, apiUrl, body)
 	if err != nil {
-		return ProxmoxVmList{}, fmt.Errorf("error while creating request: %+v\n", err)
+		return nil, fmt.Errorf("error while creating request: %+v\nurl: %s\n", err, apiUrl)
 	}
 
 	req.AddCookie(authCookie)
 	req.Header.Add("CSRFPreventionToken", token.Data.CSRF)
+	if data != nil {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return ProxmoxVmList{}, fmt.Errorf("error while performing request: %+v\n", err)
+		return nil, fmt.Errorf("error while performing request: %+v\n", err)
 	}
+	defer resp.Body.Close()
 
 	response, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return ProxmoxVmList{}, fmt.Errorf("error while reading response: %+v\n", err)
+		return nil, fmt.Errorf("error while reading response: %+v\n", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, newProxmoxApiError(method, apiUrl, resp, response)
+	}
+
+	return response, nil
+}
+
+// ProxmoxApiError is a request PVE turned down, with whatever explanation it gave
+type ProxmoxApiError struct {
+	Method     string
+	Url        string
+	StatusCode int
+	Status     string
+
+	// PVE's own explanation, plus any complaints about individual parameters
+	Message string
+	Errors  map[string]string
+}
+
+func (err *ProxmoxApiError) Error() string {
+	text := fmt.Sprintf("unexpected status code %d received: %s\nurl: %s\n", err.StatusCode, err.Status, err.Url)
+	if err.Message != "" {
+		text += fmt.Sprintf("message: %s\n", err.Message)
+	}
+	for _, parameter := range slices.Sorted(maps.Keys(err.Errors)) {
+		text += fmt.Sprintf("%s: %s\n", parameter, err.Errors[parameter])
+	}
+
+	return text
+}
+
+func newProxmoxApiError(method string, apiUrl string, resp *http.Response, response []byte) *ProxmoxApiError {
+	apiErr := &ProxmoxApiError{
+		Method:     method,
+		Url:        apiUrl,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+
+	// Not every error comes with a body, PVE often puts the reason in the status line instead
+	var body struct {
+		Message string                 `json:"message"`
+		Errors  map[string]interface{} `json:"errors"`
+	}
+	if json.Unmarshal(response, &body) == nil {
+		apiErr.Message = strings.TrimSpace(body.Message)
+		apiErr.Errors = make(map[string]string)
+		for parameter, problem := range body.Errors {
+			apiErr.Errors[parameter] = strings.TrimSpace(fmt.Sprint(problem))
+		}
+	}
+
+	return apiErr
+}
+
+func getAvailableVMList(creds ProxmoxCreds, token ProxmoxAuth) (ProxmoxVmList, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/cluster/resources/", creds.Address)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodGet, apiUrl, nil)
+	if err != nil {
+		return ProxmoxVmList{}, err
 	}
 
 	var availableVMs ProxmoxVmList
@@ -169,262 +305,386 @@ func getAvailableVMList(creds ProxmoxCreds, token ProxmoxAuth) (ProxmoxVmList, e
 	return availableVMs, nil
 }
 
-func getVmHealth(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) (string, error) {
-	authCookie := &http.Cookie{
-		Name:  "PVEAuthCookie",
-		Value: token.Data.Ticket,
-	}
-
+// getVmHealth pings the guest agent, which only answers once the guest has booted far enough to start it
+func getVmHealth(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) error {
 	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/%s/agent/ping", creds.Address, vm.Node, vm.Id)
 
-	req, err := http.NewRequest(http.MethodPost, apiUrl, nil)
-	if err != nil {
-		return "", fmt.Errorf("error while creating request: %+v\nurl: %s\n", err, apiUrl)
-	}
+	_, err := proxmoxApiRequest(creds, token, http.MethodPost, apiUrl, url.Values{})
+	return err
+}
 
-	req.AddCookie(authCookie)
-	req.Header.Add("CSRFPreventionToken", token.Data.CSRF)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+func startVM(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) (ProxmoxJobStatus, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/%s/status/start", creds.Address, vm.Node, vm.Id)
 
-	resp, err := client.Do(req)
+	response, err := proxmoxApiRequest(creds, token, http.MethodPost, apiUrl, url.Values{})
 	if err != nil {
-		return "", fmt.Errorf("error while performing request: %+v\n", err)
+		return ProxmoxJobStatus{}, err
 	}
 
-	return resp.Status, nil
+	return unmarshalJob(response)
 }
 
-func startVM(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) error {
-	authCookie := &http.Cookie{
-		Name:  "PVEAuthCookie",
-		Value: token.Data.Ticket,
+// getSpiceConfig asks PVE for a virt-viewer connection file for vm, starting it first if needed
+func getSpiceConfig(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm, proxy string) ([]byte, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/spiceconfig/nodes/%s/qemu/%d/spiceproxy", creds.Address, vm.Node, vm.VmNumber)
+
+	data := url.Values{}
+	data.Add("proxy", proxy)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodPost, apiUrl, data)
+
+	var apiErr *ProxmoxApiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == 500 && strings.Contains(apiErr.Status, "not running") {
+		job, err := startVM(creds, token, vm)
+		if err != nil {
+			return nil, fmt.Errorf("error while starting VM: %w\n", err)
+		}
+
+		_, err = waitForTask(context.Background(), creds, token, job, waitOptions("VM start", config.Timeouts.Start.Duration), nil)
+		if err != nil {
+			return nil, fmt.Errorf("error while waiting for VM to start: %w\n", err)
+		}
+
+		return getSpiceConfig(creds, token, vm, proxy)
+	} else if err != nil {
+		return nil, err
 	}
 
-	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/%s/status/start", creds.Address, vm.Node, vm.Id)
+	return response, nil
+}
 
-	req, err := http.NewRequest(http.MethodPost, apiUrl, nil)
+// connectToSpice builds the connection file for vm, with the template's settings applied on top of PVE's. It holds
+// a login ticket, so it's kept in memory until the viewer needs it
+func connectToSpice(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm, template ProxmoxVm, proxy string) (*VirtViewerFile, error) {
+	response, err := getSpiceConfig(creds, token, vm, proxy)
 	if err != nil {
-		return fmt.Errorf("error while creating request: %+v\nurl: %s\n", err, apiUrl)
+		return nil, err
 	}
 
-	req.AddCookie(authCookie)
-	req.Header.Add("CSRFPreventionToken", token.Data.CSRF)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	connectionFile, err := prepareConnectionFile(response, template)
+	if err != nil {
+		return nil, fmt.Errorf("error while preparing connection file: %+v\n", err)
+	}
 
-	resp, err := client.Do(req)
+	return connectionFile, nil
+}
+
+func getNodeAddresses(creds ProxmoxCreds, token ProxmoxAuth) ([]ProxmoxInterfaces, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/network", creds.Address, creds.Server)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodGet, apiUrl, nil)
 	if err != nil {
-		return fmt.Errorf("error while performing request: %+v\n", err)
+		return nil, err
 	}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("unexpected status code %d received: %s\nurl: %s\n", resp.StatusCode, resp.Status, apiUrl)
+	var parsedResponse rawProxmoxInterfaces
+	err = json.Unmarshal(response, &parsedResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshalling json: %+v\n", err)
 	}
 
-	return nil
+	return parsedResponse.Data, nil
 }
 
-func connectToSpice(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) error {
-	authCookie := &http.Cookie{
-		Name:  "PVEAuthCookie",
-		Value: token.Data.Ticket,
+func cloneTemplate(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm, target string) (ProxmoxVm, ProxmoxJobStatus, error) {
+	var newVm ProxmoxVm
+
+	// This is completely stupid, but I guess the least race condition prone? Oh dear god
+	for newVm.VmNumber = rand2.Int32(); newVm.VmNumber < 100000; newVm.VmNumber = rand2.Int32() {
 	}
+	newVm.Id = fmt.Sprintf("qemu/%d", newVm.VmNumber)
+	newVm.Type = "qemu"
+	newVm.Node = target
 
+	// Create data to clone the new VM to
 	data := url.Values{}
-	data.Add("proxy", creds.Address)
-
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://%s:8006/api2/spiceconfig/nodes/%s/qemu/%d/spiceproxy", creds.Address, vm.Node, vm.VmNumber), bytes.NewBufferString(data.Encode()))
-	if err != nil {
-		return fmt.Errorf("error while creating request: %+v\n", err)
+	data.Set("newid", fmt.Sprint(newVm.VmNumber))
+	data.Set("storage", os.Getenv("PVE_VDI_STORAGE"))
+	data.Set("pool", os.Getenv("PVE_VDI_POOL"))
+	if strings.Compare(target, vm.Node) != 0 {
+		data.Set("target", target)
 	}
 
-	req.AddCookie(authCookie)
-	req.Header.Add("CSRFPreventionToken", token.Data.CSRF)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d/clone", creds.Address, vm.Node, vm.VmNumber)
+	response, err := proxmoxApiRequest(creds, token, http.MethodPost, apiUrl, data)
 
-	resp, err := client.Do(req)
+	// Bodge solution for generating an invalid VM ID
+	var apiErr *ProxmoxApiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == 400 && strings.Contains(apiErr.Errors["newid"], "valid VM ID") {
+		return cloneTemplate(creds, token, vm, target)
+	} else if err != nil {
+		return ProxmoxVm{}, ProxmoxJobStatus{}, err
+	}
+
+	job, err := unmarshalJob(response)
 	if err != nil {
-		return fmt.Errorf("error while performing request: %+v\n", err)
+		return ProxmoxVm{}, ProxmoxJobStatus{}, err
 	}
 
-	if resp.StatusCode == 500 && strings.Contains(resp.Status, "not running") {
-		err = startVM(creds, token, vm)
-		if err != nil {
-			return fmt.Errorf("error while starting VM: %+v\n", err)
-		}
+	return newVm, job, nil
+}
 
-		return connectToSpice(creds, token, vm)
-	} else if resp.StatusCode != 200 {
-		return fmt.Errorf("unexpected status %d received: %s\n", resp.StatusCode, resp.Status)
+// Tag applied to every clone we create, so we can find our desktops again later
+const vdiTag = "pve-vdi"
+
+func hasVdiTag(vm ProxmoxVm) bool {
+	return hasTag(vm, vdiTag)
+}
+
+// PVE tags are lowercase letters, digits and a handful of punctuation, everything else gets swapped for a dash
+var tagUnsafePattern = regexp.MustCompile(`[^a-z0-9_+.-]`)
+
+// vdiUserTag marks which user a clone belongs to, so we can find their running sessions again
+func vdiUserTag(username string) string {
+	return "vdi-user-" + tagUnsafePattern.ReplaceAllString(strings.ToLower(username), "-")
+}
+
+// vdiTemplateTag marks which template a clone was made from
+func vdiTemplateTag(template ProxmoxVm) string {
+	return fmt.Sprintf("vdi-tpl-%d", template.VmNumber)
+}
+
+func hasTag(vm ProxmoxVm, wanted string) bool {
+	for _, tag := range strings.Split(vm.Tags, ";") {
+		if strings.Compare(tag, wanted) == 0 {
+			return true
+		}
 	}
 
-	response, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("error while reading request: %+v\n", err)
+	return false
+}
+
+// tagVdiClone marks a freshly cloned VM as a VDI desktop, keeping any tags inherited from the template
+func tagVdiClone(creds ProxmoxCreds, token ProxmoxAuth, clone ProxmoxVm, template ProxmoxVm) error {
+	tags := strings.Join([]string{vdiTag, vdiUserTag(creds.Username), vdiTemplateTag(template)}, ";")
+	if template.Tags != "" {
+		tags = fmt.Sprintf("%s;%s", template.Tags, tags)
 	}
 
-	filename := os.Getenv("VDI_TEMPFILE_FILENAME")
+	data := url.Values{}
+	data.Set("tags", tags)
 
-	spiceHandler, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	return setVmConfig(creds, token, clone, data)
+}
+
+func getVmConfig(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) (ProxmoxVmConfig, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d/config", creds.Address, vm.Node, vm.VmNumber)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodGet, apiUrl, nil)
 	if err != nil {
-		return fmt.Errorf("error while creating file %s: %+v\n", filename, err)
+		return nil, err
 	}
 
-	_, err = spiceHandler.Write(response)
+	var parsedResponse rawProxmoxVmConfig
+	err = json.Unmarshal(response, &parsedResponse)
 	if err != nil {
-		return fmt.Errorf("error while writing connection info to %s: %+v\n", filename, err)
+		return nil, fmt.Errorf("error while unmarshalling json: %+v\n", err)
 	}
 
-	return nil
+	return parsedResponse.Data, nil
 }
 
-func getNodeAddresses(creds ProxmoxCreds, token ProxmoxAuth) ([]ProxmoxInterfaces, error) {
-	authCookie := &http.Cookie{
-		Name:  "PVEAuthCookie",
-		Value: token.Data.Ticket,
+// Get returns a config value as a string, PVE hands back a mix of strings and numbers
+func (vmConfig ProxmoxVmConfig) Get(key string) string {
+	value, exists := vmConfig[key]
+	if !exists || value == nil {
+		return ""
 	}
 
-	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/network", creds.Address, creds.Server)
+	return fmt.Sprint(value)
+}
 
-	req, err := http.NewRequest(http.MethodGet, apiUrl, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error while creating request: %+v\nurl: %s\n", err, apiUrl)
-	}
+func setVmConfig(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm, data url.Values) error {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d/config", creds.Address, vm.Node, vm.VmNumber)
 
-	req.AddCookie(authCookie)
-	req.Header.Add("CSRFPreventionToken", token.Data.CSRF)
+	_, err := proxmoxApiRequest(creds, token, http.MethodPut, apiUrl, data)
+	return err
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error while performing request: %+v\n", err)
-	}
+// resizeDisk grows one of vm's disks. Newer PVE versions hand back a task, older ones finish before answering and
+// the job's ID is left empty
+func resizeDisk(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm, disk string, size string) (ProxmoxJobStatus, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d/resize", creds.Address, vm.Node, vm.VmNumber)
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("unexpected status code %d received: %s\nurl: %s\n", resp.StatusCode, resp.Status, apiUrl)
-	}
+	data := url.Values{}
+	data.Set("disk", disk)
+	data.Set("size", size)
 
-	interfaces, err := io.ReadAll(resp.Body)
+	response, err := proxmoxApiRequest(creds, token, http.MethodPut, apiUrl, data)
 	if err != nil {
-		return nil, fmt.Errorf("Error while parsing response: %+v\n", err)
+		return ProxmoxJobStatus{}, err
 	}
 
-	var parsedResponse rawProxmoxInterfaces
+	return unmarshalJob(response)
+}
+
+func migrateVM(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm, target string) (ProxmoxJobStatus, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d/migrate", creds.Address, vm.Node, vm.VmNumber)
+
+	data := url.Values{}
+	data.Set("target", target)
+	data.Set("online", "1")
+	data.Set("with-local-disks", "1")
 
-	err = json.Unmarshal(interfaces, &parsedResponse)
+	response, err := proxmoxApiRequest(creds, token, http.MethodPost, apiUrl, data)
 	if err != nil {
-		return nil, fmt.Errorf("Error while unmarshalling response: %+v\n", err)
+		return ProxmoxJobStatus{}, err
 	}
 
-	return parsedResponse.Data, nil
+	return unmarshalJob(response)
 }
 
-func cloneTemplate(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) (ProxmoxVm, ProxmoxJobStatus, error) {
-	// Boilerplate create cookie
-	authCookie := &http.Cookie{
-		Name:  "PVEAuthCookie",
-		Value: token.Data.Ticket,
+// Node returns the node a task is running on, taken from its UPID, or fallback if the UPID can't be parsed
+func (job ProxmoxJobStatus) Node(fallback string) string {
+	// UPID:node:pid:pstart:starttime:type:id:user:
+	fields := strings.Split(job.JobId, ":")
+	if len(fields) < 2 || strings.Compare(fields[0], "UPID") != 0 || fields[1] == "" {
+		return fallback
 	}
 
-	var newVm ProxmoxVm
-	var err error
+	return fields[1]
+}
 
-	// This is completely stupid, but I guess the least race condition prone? Oh dear god
-	for newVm.VmNumber = rand2.Int32(); newVm.VmNumber < 100000; newVm.VmNumber = rand2.Int32() {
+// unmarshalJob reads the UPID returned by API calls that kick off a task
+func unmarshalJob(response []byte) (ProxmoxJobStatus, error) {
+	var resp struct {
+		Data string `json:"data"`
 	}
 
-	// Create data to clone the new VM to
-	data := url.Values{}
-	data.Set("newid", fmt.Sprint(newVm.VmNumber))
-	data.Set("storage", os.Getenv("PVE_VDI_STORAGE"))
-	data.Set("pool", os.Getenv("PVE_VDI_POOL"))
+	err := json.Unmarshal(response, &resp)
+	if err != nil {
+		return ProxmoxJobStatus{}, fmt.Errorf("error while unmarshalling json: %+v\n", err)
+	}
 
-	// Create POST request
-	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d/clone", creds.Address, vm.Node, vm.VmNumber)
-	cloneVmReq, err := http.NewRequest(http.MethodPost, apiUrl, bytes.NewBufferString(data.Encode()))
+	return ProxmoxJobStatus{JobId: resp.Data}, nil
+}
+
+func stopVM(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) (ProxmoxJobStatus, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d/status/stop", creds.Address, vm.Node, vm.VmNumber)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodPost, apiUrl, url.Values{})
 	if err != nil {
-		return ProxmoxVm{}, ProxmoxJobStatus{}, fmt.Errorf("error while creating request: %+v\nurl: %s\n", err, apiUrl)
+		return ProxmoxJobStatus{}, err
 	}
 
-	// Add the auth cookies to the request
-	cloneVmReq.AddCookie(authCookie)
-	cloneVmReq.Header.Add("CSRFPreventionToken", token.Data.CSRF)
+	return unmarshalJob(response)
+}
+
+func destroyVM(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) (ProxmoxJobStatus, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d?purge=1&destroy-unreferenced-disks=1", creds.Address, vm.Node, vm.VmNumber)
 
-	// Perform the request
-	cloneVmResp, err := client.Do(cloneVmReq)
+	response, err := proxmoxApiRequest(creds, token, http.MethodDelete, apiUrl, nil)
 	if err != nil {
-		return ProxmoxVm{}, ProxmoxJobStatus{}, fmt.Errorf("error while performing request: %+v\n", err)
+		return ProxmoxJobStatus{}, err
 	}
 
-	if cloneVmResp.StatusCode != 200 {
-		response, err := io.ReadAll(cloneVmResp.Body)
-		if err != nil {
-			return ProxmoxVm{}, ProxmoxJobStatus{}, fmt.Errorf("got unexpected status code %d: %s\n", cloneVmResp.StatusCode, cloneVmResp.Status)
-		}
+	return unmarshalJob(response)
+}
 
-		// Bodge solution for generating an invalid VM ID
-		if cloneVmResp.StatusCode == 400 && strings.Contains(fmt.Sprintf("%s", response), "invalid format - value does not look like a valid VM ID\\n") {
-			generatedVm, jobStatus, err := cloneTemplate(creds, token, vm)
-			return generatedVm, jobStatus, err
-		} else {
-			return ProxmoxVm{}, ProxmoxJobStatus{}, fmt.Errorf("got unexpected status code %d: %s: %s\n", cloneVmResp.StatusCode, cloneVmResp.Status, response)
-		}
+// getVmStatus returns the current power state of vm, e.g. "running" or "stopped"
+func getVmStatus(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) (string, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d/status/current", creds.Address, vm.Node, vm.VmNumber)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodGet, apiUrl, nil)
+	if err != nil {
+		return "", err
 	}
 
 	var resp struct {
-		Data string `json:"data"`
+		Data struct {
+			Status string `json:"status"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(response, &resp)
+	if err != nil {
+		return "", fmt.Errorf("error while unmarshalling json: %+v\n", err)
 	}
 
-	body, err := io.ReadAll(cloneVmResp.Body)
+	return resp.Data.Status, nil
+}
+
+// stopJob aborts a running task
+func stopJob(creds ProxmoxCreds, token ProxmoxAuth, job ProxmoxJobStatus) error {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/tasks/%s", creds.Address, job.Node(creds.Server), job.JobId)
+
+	_, err := proxmoxApiRequest(creds, token, http.MethodDelete, apiUrl, nil)
+	return err
+}
+
+// getGuestInterfaces asks the guest agent for the VM's network interfaces
+func getGuestInterfaces(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) ([]ProxmoxGuestInterface, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d/agent/network-get-interfaces", creds.Address, vm.Node, vm.VmNumber)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodGet, apiUrl, nil)
 	if err != nil {
-		return ProxmoxVm{}, ProxmoxJobStatus{}, fmt.Errorf("Error while reading body: %v\n", err)
+		return nil, err
 	}
 
-	err = json.Unmarshal(body, &resp)
+	var parsedResponse rawProxmoxGuestInterfaces
+	err = json.Unmarshal(response, &parsedResponse)
 	if err != nil {
-		return ProxmoxVm{}, ProxmoxJobStatus{}, fmt.Errorf("Error while unmarshalling body: %v\n", err)
+		return nil, fmt.Errorf("error while unmarshalling json: %+v\n", err)
 	}
 
-	return newVm, ProxmoxJobStatus{JobId: resp.Data}, nil
+	return parsedResponse.Data.Result, nil
 }
 
-func getJobStatus(creds ProxmoxCreds, token ProxmoxAuth, job ProxmoxJobStatus) (ProxmoxJobStatus, error) {
-	authCookie := &http.Cookie{
-		Name:  "PVEAuthCookie",
-		Value: token.Data.Ticket,
-	}
+// getGuestOsInfo asks the guest agent which OS is running, which only works once the guest has booted properly
+func getGuestOsInfo(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) (map[string]interface{}, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d/agent/get-osinfo", creds.Address, vm.Node, vm.VmNumber)
 
-	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/tasks/%s/status", creds.Address, creds.Server, job.JobId)
+	response, err := proxmoxApiRequest(creds, token, http.MethodGet, apiUrl, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	req, err := http.NewRequest(http.MethodGet, apiUrl, nil)
+	var resp struct {
+		Data struct {
+			Result map[string]interface{} `json:"result"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(response, &resp)
 	if err != nil {
-		return ProxmoxJobStatus{}, fmt.Errorf("error while creating request: %+v\nurl: %s\n", err, apiUrl)
+		return nil, fmt.Errorf("error while unmarshalling json: %+v\n", err)
 	}
 
-	req.AddCookie(authCookie)
-	req.Header.Add("CSRFPreventionToken", token.Data.CSRF)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return resp.Data.Result, nil
+}
 
-	resp, err := client.Do(req)
+// Most lines of task log returned by a single call to getJobLog
+const taskLogPageSize = 500
+
+// getJobLog fetches the lines of a task's log starting from line start
+func getJobLog(creds ProxmoxCreds, token ProxmoxAuth, job ProxmoxJobStatus, start int) ([]ProxmoxTaskLogLine, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/tasks/%s/log?start=%d&limit=%d", creds.Address, job.Node(creds.Server), job.JobId, start, taskLogPageSize)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodGet, apiUrl, nil)
 	if err != nil {
-		return ProxmoxJobStatus{}, fmt.Errorf("error while performing request: %+v\n", err)
+		return nil, err
 	}
-	log.Printf("Performed job status lookup\nStatus code: %d\nStatus: %s\n", resp.StatusCode, resp.Status)
 
-	if resp.StatusCode != 200 {
-		return ProxmoxJobStatus{}, fmt.Errorf("unexpected status code %d returned from server: %s\n", resp.StatusCode, resp.Status)
+	var parsedResponse rawProxmoxTaskLog
+	err = json.Unmarshal(response, &parsedResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshalling json: %+v\n", err)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	return parsedResponse.Data, nil
+}
+
+func getJobStatus(creds ProxmoxCreds, token ProxmoxAuth, job ProxmoxJobStatus) (ProxmoxJobStatus, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/tasks/%s/status", creds.Address, job.Node(creds.Server), job.JobId)
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodGet, apiUrl, nil)
 	if err != nil {
-		return ProxmoxJobStatus{}, fmt.Errorf("error while reading response from server: %v\n", err)
+		return ProxmoxJobStatus{}, err
 	}
-	log.Printf("Read body\n")
 
 	var jobStatus rawProxmoxJobStatus
-	err = json.Unmarshal(body, &jobStatus)
+	err = json.Unmarshal(response, &jobStatus)
 	if err != nil {
-		return ProxmoxJobStatus{}, fmt.Errorf("error while unmarshalling json from server: %v\n", err)
+		return ProxmoxJobStatus{}, fmt.Errorf("error while unmarshalling json: %+v\n", err)
 	}
-	log.Printf("Parsed body\n")
 
 	return jobStatus.Data, nil
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SPICE if the desktop has a qxl display, VNC otherwise
+	ProtocolAuto = "auto"
+
+	ProtocolSpice = "spice"
+	ProtocolVnc   = "vnc"
+	ProtocolRdp   = "rdp"
+)
+
+func validProtocol(protocol string) bool {
+	switch protocol {
+	case ProtocolAuto, ProtocolSpice, ProtocolVnc, ProtocolRdp:
+		return true
+	default:
+		return false
+	}
+}
+
+type RdpConfig struct {
+	// RDP client to run, either on the PATH or a full path. Defaults to xfreerdp
+	Client string `json:"client,omitempty"`
+
+	// The client's command line. Each argument is a text/template, see RdpTemplateData, and arguments that come out
+	// empty are left off. Defaults to defaultRdpArgs
+	Args []string `json:"args,omitempty"`
+
+	// Extra arguments, added after Args. A template's are added after the client's
+	ExtraArgs []string `json:"extra_args,omitempty"`
+
+	// Port the guest's RDP server listens on. Defaults to 3389
+	Port int `json:"port,omitempty"`
+
+	// Wait for the port to accept connections before starting the client. Windows takes a while to get RDP going
+	// after the agent comes up, so this defaults to on
+	WaitForPort *bool `json:"wait_for_port,omitempty"`
+
+	// Only use guest addresses in this network, such as 10.0.0.0/8, for desktops with more than one NIC
+	Network string `json:"network,omitempty"`
+
+	// Extra environment variables for the client
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// RdpTemplateData is what RDP client arguments can refer to, such as {{.Host}}
+type RdpTemplateData struct {
+	Host string
+	Port int
+
+	// The user's PVE username without the realm, such as jsmith for jsmith@pve
+	User string
+
+	// Name of the desktop the user picked
+	Name  string
+	Kiosk bool
+}
+
+var defaultRdpArgs = []string{
+	"/v:{{.Host}}:{{.Port}}",
+	"/u:{{.User}}",
+	"/t:{{.Name}}",
+	"/cert:ignore",
+	"/dynamic-resolution",
+	"+clipboard",
+	"/f",
+}
+
+// sessionProtocol decides how to reach the desktop. Anything but RDP is shown through the viewer
+func sessionProtocol(template ProxmoxVm, vmConfig ProxmoxVmConfig) string {
+	switch protocol := templateConfig(template).Protocol; protocol {
+	case ProtocolSpice, ProtocolVnc, ProtocolRdp:
+		return protocol
+	}
+
+	// SPICE only works with a qxl display, anything else gets VNC instead
+	if spiceAvailable(vmConfig) {
+		return ProtocolSpice
+	}
+	return ProtocolVnc
+}
+
+// rdpConfig merges the template's RDP settings over the client's
+func rdpConfig(template ProxmoxVm) RdpConfig {
+	settings := config.Rdp
+	override := templateConfig(template).Rdp
+
+	if override.Client != "" {
+		settings.Client = override.Client
+	}
+	if len(override.Args) > 0 {
+		settings.Args = override.Args
+	}
+	if override.Port != 0 {
+		settings.Port = override.Port
+	}
+	if override.WaitForPort != nil {
+		settings.WaitForPort = override.WaitForPort
+	}
+	if override.Network != "" {
+		settings.Network = override.Network
+	}
+	settings.ExtraArgs = append(append([]string{}, settings.ExtraArgs...), override.ExtraArgs...)
+
+	settings.Env = maps.Clone(settings.Env)
+	if settings.Env == nil {
+		settings.Env = make(map[string]string)
+	}
+	maps.Copy(settings.Env, override.Env)
+
+	return settings
+}
+
+func validateRdpConfig(settings RdpConfig) error {
+	if settings.Port < 0 || settings.Port > 65535 {
+		return fmt.Errorf("invalid RDP port %d\n", settings.Port)
+	}
+
+	if settings.Network != "" {
+		_, err := netip.ParsePrefix(settings.Network)
+		if err != nil {
+			return fmt.Errorf("invalid RDP network %s: %+v\n", settings.Network, err)
+		}
+	}
+
+	return nil
+}
+
+// connectRdp finds the clone's address through the guest agent and runs the RDP client against it, blocking until
+// the user closes it
+func connectRdp(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, template ProxmoxVm, clone ProxmoxVm, status func(string)) error {
+	settings := rdpConfig(template)
+
+	status("Finding the desktop's address")
+	var address netip.Addr
+	err := backoffPoll(ctx, waitOptions("the desktop's address", config.Timeouts.Ready.Duration), func() (bool, error) {
+		interfaces, err := getGuestInterfaces(creds, token, clone)
+		if err != nil {
+			log.Printf("Couldn't read %d's network interfaces yet: %+v\n", clone.VmNumber, err)
+			return false, nil
+		}
+
+		var found bool
+		address, found = guestRdpAddress(interfaces, settings.Network)
+		return found, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error while finding the desktop's address, is the guest agent installed?: %w\n", err)
+	}
+	target := net.JoinHostPort(address.String(), strconv.Itoa(settings.Port))
+	log.Printf("Connecting to %d over RDP at %s\n", clone.VmNumber, target)
+
+	if settings.WaitForPort == nil || *settings.WaitForPort {
+		status("Waiting for remote desktop")
+		err = backoffPoll(ctx, waitOptions("remote desktop", config.Timeouts.Ready.Duration), func() (bool, error) {
+			conn, err := net.DialTimeout("tcp", target, nodeProbeTimeout)
+			if err != nil {
+				return false, nil
+			}
+			conn.Close()
+			return true, nil
+		})
+		if err != nil {
+			return fmt.Errorf("error while waiting for %s to accept RDP connections: %w\n", target, err)
+		}
+	}
+
+	username, _, _ := strings.Cut(creds.Username, "@")
+	args, err := renderArgs(settings.Args, RdpTemplateData{
+		Host:  address.String(),
+		Port:  settings.Port,
+		User:  username,
+		Name:  template.Name,
+		Kiosk: config.Kiosk.Enabled,
+	})
+	if err != nil {
+		return err
+	}
+
+	status("Connected")
+	return runViewer(ViewerConfig{Env: settings.Env}, settings.Client, append(args, settings.ExtraArgs...), nil)
+}
+
+// guestRdpAddress picks the address to connect to out of what the guest agent reports. IPv4 is preferred since
+// that's what RDP is almost always set up for
+func guestRdpAddress(interfaces []ProxmoxGuestInterface, network string) (netip.Addr, bool) {
+	var allowed netip.Prefix
+	if network != "" {
+		allowed = netip.MustParsePrefix(network)
+	}
+
+	var fallback netip.Addr
+	for _, iface := range interfaces {
+		for _, address := range iface.IpAddresses {
+			addr, err := netip.ParseAddr(address.Address)
+			if err != nil || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+				continue
+			}
+			if allowed.IsValid() && !allowed.Contains(addr) {
+				continue
+			}
+
+			if addr.Is4() {
+				return addr, true
+			} else if !fallback.IsValid() {
+				fallback = addr
+			}
+		}
+	}
+
+	return fallback, fallback.IsValid()
+}
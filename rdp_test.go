@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGuestRdpAddress(t *testing.T) {
+	tests := []struct {
+		name       string
+		interfaces string
+		network    string
+		want       string
+	}{
+		{
+			name:       "no interfaces",
+			interfaces: `[]`,
+			want:       "",
+		},
+		{
+			name: "loopback and link-local are skipped",
+			interfaces: `[
+				{"name": "lo", "ip-addresses": [{"ip-address": "127.0.0.1", "ip-address-type": "ipv4"}, {"ip-address": "::1", "ip-address-type": "ipv6"}]},
+				{"name": "eth0", "ip-addresses": [{"ip-address": "fe80::1", "ip-address-type": "ipv6"}, {"ip-address": "169.254.10.2", "ip-address-type": "ipv4"}, {"ip-address": "10.0.0.5", "ip-address-type": "ipv4"}]}
+			]`,
+			want: "10.0.0.5",
+		},
+		{
+			name: "IPv4 preferred over an earlier IPv6",
+			interfaces: `[
+				{"name": "eth0", "ip-addresses": [{"ip-address": "2001:db8::5", "ip-address-type": "ipv6"}]},
+				{"name": "eth1", "ip-addresses": [{"ip-address": "10.0.0.5", "ip-address-type": "ipv4"}]}
+			]`,
+			want: "10.0.0.5",
+		},
+		{
+			name: "IPv6 when there's nothing else",
+			interfaces: `[
+				{"name": "eth0", "ip-addresses": [{"ip-address": "fe80::1", "ip-address-type": "ipv6"}, {"ip-address": "2001:db8::5", "ip-address-type": "ipv6"}, {"ip-address": "2001:db8::6", "ip-address-type": "ipv6"}]}
+			]`,
+			want: "2001:db8::5",
+		},
+		{
+			name: "network picks the right interface",
+			interfaces: `[
+				{"name": "docker0", "ip-addresses": [{"ip-address": "172.17.0.1", "ip-address-type": "ipv4"}]},
+				{"name": "eth0", "ip-addresses": [{"ip-address": "10.0.0.5", "ip-address-type": "ipv4"}]}
+			]`,
+			network: "10.0.0.0/24",
+			want:    "10.0.0.5",
+		},
+		{
+			name: "network nothing matches",
+			interfaces: `[
+				{"name": "eth0", "ip-addresses": [{"ip-address": "192.168.1.5", "ip-address-type": "ipv4"}, {"ip-address": "2001:db8::5", "ip-address-type": "ipv6"}]}
+			]`,
+			network: "10.0.0.0/8",
+			want:    "",
+		},
+		{
+			name: "IPv6 network",
+			interfaces: `[
+				{"name": "eth0", "ip-addresses": [{"ip-address": "192.168.1.5", "ip-address-type": "ipv4"}, {"ip-address": "2001:db8::5", "ip-address-type": "ipv6"}]}
+			]`,
+			network: "2001:db8::/64",
+			want:    "2001:db8::5",
+		},
+		{
+			name: "garbage from the agent is ignored",
+			interfaces: `[
+				{"name": "eth0", "ip-addresses": [{"ip-address": "", "ip-address-type": "ipv4"}, {"ip-address": "not-an-ip", "ip-address-type": "ipv4"}, {"ip-address": "0.0.0.0", "ip-address-type": "ipv4"}, {"ip-address": "10.0.0.5", "ip-address-type": "ipv4"}]}
+			]`,
+			want: "10.0.0.5",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var interfaces []ProxmoxGuestInterface
+			if err := json.Unmarshal([]byte(test.interfaces), &interfaces); err != nil {
+				t.Fatal(err)
+			}
+
+			addr, found := guestRdpAddress(interfaces, test.network)
+			if found != (test.want != "") {
+				t.Fatalf("guestRdpAddress() found = %v, want %v", found, test.want != "")
+			}
+			if found && addr.String() != test.want {
+				t.Errorf("guestRdpAddress() = %s, want %s", addr, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ReadinessAgentPing    = "agent-ping"
+	ReadinessAgentOsInfo  = "agent-osinfo"
+	ReadinessAgentNetwork = "agent-network"
+	ReadinessSpicePort    = "spice-port"
+	ReadinessDelay        = "delay"
+	ReadinessNone         = "none"
+)
+
+type ReadinessConfig struct {
+	// Which probe decides the desktop is ready, see the Readiness* constants. Defaults to agent-ping when the
+	// template has the guest agent turned on, otherwise spice-port for SPICE desktops and none for the rest
+	Probe string `json:"probe,omitempty"`
+
+	// How long to wait with the "delay" probe
+	Delay Duration `json:"delay,omitempty"`
+
+	// Give up on the probe after this long and connect anyway. Defaults to the ready timeout
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// readinessProbe reports whether the desktop is ready. Errors are treated as "not yet", since agents and ports
+// failing is exactly what a booting VM looks like
+type readinessProbe func() (bool, error)
+
+func validReadinessProbe(probe string) bool {
+	switch probe {
+	case ReadinessAgentPing, ReadinessAgentOsInfo, ReadinessAgentNetwork, ReadinessSpicePort, ReadinessDelay, ReadinessNone:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitForDesktop blocks until the template's readiness probe passes. If it doesn't pass in time we carry on
+// regardless, a desktop that's a bit slow is still better than no desktop
+func waitForDesktop(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, template ProxmoxVm, clone ProxmoxVm, spiceProxy string) error {
+	readiness := templateConfig(template).Readiness
+
+	timeout := readiness.Timeout.Duration
+	if timeout == 0 {
+		timeout = config.Timeouts.Ready.Duration
+	}
+
+	probeName := readiness.Probe
+	if probeName == "" {
+		vmConfig, err := getVmConfig(creds, token, clone)
+		if err != nil {
+			log.Printf("Couldn't read %d's config to pick a readiness probe, asking the agent: %+v\n", clone.VmNumber, err)
+			probeName = ReadinessAgentPing
+		} else {
+			probeName = defaultReadinessProbe(template, vmConfig)
+		}
+	}
+
+	var probe readinessProbe
+	switch probeName {
+	case ReadinessNone:
+		return nil
+	case ReadinessDelay:
+		timer := time.NewTimer(readiness.Delay.Duration)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		}
+	case ReadinessAgentOsInfo:
+		probe = func() (bool, error) {
+			_, err := getGuestOsInfo(creds, token, clone)
+			return err == nil, err
+		}
+	case ReadinessAgentNetwork:
+		probe = func() (bool, error) {
+			interfaces, err := getGuestInterfaces(creds, token, clone)
+			return err == nil && guestHasAddress(interfaces), err
+		}
+	case ReadinessSpicePort:
+		probe = func() (bool, error) {
+			return probeSpicePort(creds, token, clone, spiceProxy)
+		}
+	default:
+		probe = func() (bool, error) {
+			err := getVmHealth(creds, token, clone)
+			return err == nil, err
+		}
+	}
+
+	err := backoffPoll(ctx, waitOptions("the desktop", timeout), func() (bool, error) {
+		ready, err := probe()
+		if err != nil {
+			log.Printf("Desktop %d not ready yet: %+v\n", clone.VmNumber, err)
+		}
+		return ready, nil
+	})
+
+	// Only our own timeout means connect anyway, the overall deadline running out is still a failure
+	if errors.Is(err, errPhaseTimeout) && ctx.Err() == nil {
+		log.Printf("Readiness probe for %d didn't pass in %s, connecting anyway\n", clone.VmNumber, timeout)
+		return nil
+	}
+
+	return err
+}
+
+// defaultReadinessProbe picks a probe that can actually pass for this desktop. Pinging an agent that isn't there
+// would just sit out the whole timeout
+func defaultReadinessProbe(template ProxmoxVm, vmConfig ProxmoxVmConfig) string {
+	if agentEnabled(vmConfig) {
+		return ReadinessAgentPing
+	}
+
+	if strings.Compare(sessionProtocol(template, vmConfig), ProtocolSpice) == 0 {
+		return ReadinessSpicePort
+	}
+	return ReadinessNone
+}
+
+// agentEnabled reads the agent option, which is either a bare flag such as "1" or "enabled=1", followed by
+// other settings
+func agentEnabled(vmConfig ProxmoxVmConfig) bool {
+	for _, option := range strings.Split(vmConfig.Get("agent"), ",") {
+		key, value, found := strings.Cut(option, "=")
+		if !found {
+			value = key
+		} else if strings.Compare(key, "enabled") != 0 {
+			continue
+		}
+
+		switch strings.ToLower(value) {
+		case "1", "on", "yes", "true":
+			return true
+		}
+		return false
+	}
+
+	return false
+}
+
+// guestHasAddress checks for a routable address on any interface, which is a decent sign the network stack is up
+func guestHasAddress(interfaces []ProxmoxGuestInterface) bool {
+	for _, iface := range interfaces {
+		for _, address := range iface.IpAddresses {
+			addr, err := netip.ParseAddr(address.Address)
+			if err == nil && !addr.IsLoopback() && !addr.IsLinkLocalUnicast() {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// probeSpicePort asks the SPICE proxy to connect us to the VM's display, exactly like the viewer will
+func probeSpicePort(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm, spiceProxy string) (bool, error) {
+	spiceConfig, err := getSpiceConfig(creds, token, vm, spiceProxy)
+	if err != nil {
+		return false, err
+	}
+
+	connectionFile, err := parseVirtViewerFile(spiceConfig)
+	if err != nil {
+		return false, err
+	}
+
+	proxyUrl, err := url.Parse(connectionFile.Get("proxy"))
+	if err != nil || proxyUrl.Host == "" {
+		return false, fmt.Errorf("connection file has no usable proxy: %+v\n", err)
+	}
+
+	port := connectionFile.Get("tls-port")
+	if port == "" {
+		port = connectionFile.Get("port")
+	}
+	target := net.JoinHostPort(connectionFile.Get("host"), port)
+
+	conn, err := net.DialTimeout("tcp", proxyUrl.Host, nodeProbeTimeout)
+	if err != nil {
+		return false, fmt.Errorf("error while connecting to SPICE proxy %s: %+v\n", proxyUrl.Host, err)
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(nodeProbeTimeout))
+	if err != nil {
+		return false, err
+	}
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.0\r\nHost: %s\r\n\r\n", target, target)
+	if err != nil {
+		return false, fmt.Errorf("error while sending CONNECT to SPICE proxy: %+v\n", err)
+	}
+
+	statusLine, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("error while reading SPICE proxy response: %+v\n", err)
+	}
+
+	fields := strings.Fields(statusLine)
+	if len(fields) < 2 || strings.Compare(fields[1], "200") != 0 {
+		return false, fmt.Errorf("SPICE proxy refused connection: %s\n", strings.TrimSpace(statusLine))
+	}
+
+	return true, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestDefaultReadinessProbe(t *testing.T) {
+	template := ProxmoxVm{Type: "qemu", VmNumber: 900}
+
+	tests := []struct {
+		name     string
+		vmConfig ProxmoxVmConfig
+		protocol string
+		want     string
+	}{
+		{"agent on", ProxmoxVmConfig{"agent": "1", "vga": "qxl"}, "", ReadinessAgentPing},
+		{"agent on with options", ProxmoxVmConfig{"agent": "enabled=1,fstrim_cloned_disks=1"}, "", ReadinessAgentPing},
+		{"agent flag with options", ProxmoxVmConfig{"agent": "1,type=virtio"}, "", ReadinessAgentPing},
+		{"agent off", ProxmoxVmConfig{"agent": "0", "vga": "qxl"}, "", ReadinessSpicePort},
+		{"agent switched off with options", ProxmoxVmConfig{"agent": "enabled=0,type=isa", "vga": "qxl2"}, "", ReadinessSpicePort},
+		{"agent options but not enabled", ProxmoxVmConfig{"agent": "type=virtio", "vga": "qxl"}, "", ReadinessSpicePort},
+		{"no agent, VNC", ProxmoxVmConfig{"vga": "std"}, "", ReadinessNone},
+		{"no agent, SPICE forced", ProxmoxVmConfig{}, ProtocolSpice, ReadinessSpicePort},
+		{"no agent, RDP", ProxmoxVmConfig{"vga": "qxl"}, ProtocolRdp, ReadinessNone},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config = VdiConfig{Templates: map[string]TemplateConfig{"900": {Protocol: test.protocol}}}
+			t.Cleanup(func() { config = VdiConfig{} })
+
+			if got := defaultReadinessProbe(template, test.vmConfig); got != test.want {
+				t.Errorf("defaultReadinessProbe() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
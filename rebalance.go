@@ -0,0 +1,289 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RebalanceConfig struct {
+	// Largest acceptable gap in memory usage between the busiest and quietest node, 0.2 being 20%. Defaults to 0.2,
+	// 0 keeps migrating for as long as it narrows the gap at all
+	Threshold *float64 `json:"threshold,omitempty"`
+
+	// How many migrations may run at the same time, 2 by default
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// Upper bound on the migrations planned in a single pass, 10 by default
+	MaxMigrations int `json:"max_migrations,omitempty"`
+}
+
+type plannedMigration struct {
+	Vm     ProxmoxVm
+	Target string
+}
+
+// rebalanceCommand implements `pvevdi rebalance`, either as a one-shot or as a background job with -interval
+func rebalanceCommand(args []string, creds ProxmoxCreds, token ProxmoxAuth) error {
+	flags := flag.NewFlagSet("rebalance", flag.ContinueOnError)
+	threshold := flags.Float64("threshold", *config.Rebalance.Threshold, "maximum memory usage gap between nodes before migrating")
+	maxConcurrent := flags.Int("max-concurrent", config.Rebalance.MaxConcurrent, "maximum number of migrations running at once")
+	maxMigrations := flags.Int("max-migrations", config.Rebalance.MaxMigrations, "maximum number of migrations per pass")
+	interval := flags.Duration("interval", 0, "keep running, rebalancing this often")
+	dryRun := flags.Bool("dry-run", false, "only print the migrations that would be performed")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	opts := RebalanceConfig{Threshold: threshold, MaxConcurrent: *maxConcurrent, MaxMigrations: *maxMigrations}
+
+	for {
+		err = rebalance(creds, token, opts, *dryRun)
+		if err != nil && *interval == 0 {
+			return err
+		} else if err != nil {
+			log.Printf("Error while rebalancing: %+v\n", err)
+		}
+
+		if *interval == 0 {
+			return nil
+		}
+
+		time.Sleep(*interval)
+
+		// Tickets only last a couple of hours, so grab a fresh one for every pass. If that fails the old one may
+		// well still be good
+		if renewed, err := connectToProxmox(creds); err == nil {
+			token = renewed
+		} else {
+			log.Printf("Error while renewing Proxmox ticket: %+v\n", err)
+		}
+	}
+}
+
+// rebalance runs a single pass: plan migrations for running VDI desktops, then carry them out
+func rebalance(creds ProxmoxCreds, token ProxmoxAuth, opts RebalanceConfig, dryRun bool) error {
+	resources, err := getAvailableVMList(creds, token)
+	if err != nil {
+		return fmt.Errorf("error while getting cluster resources: %w\n", err)
+	}
+
+	storages := desktopStorages(creds, token, resources)
+	migrations := planMigrations(resources, getNodeStates(creds, token, resources), opts, func(desktop ProxmoxVm, node string) bool {
+		return migrationAllowed(resources, storages, desktop, node)
+	})
+	if len(migrations) == 0 {
+		log.Printf("Cluster is balanced, nothing to do\n")
+		return nil
+	}
+
+	for _, migration := range migrations {
+		log.Printf("Planned migration of %s (%d) from %s to %s\n", migration.Vm.Name, migration.Vm.VmNumber, migration.Vm.Node, migration.Target)
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	failed := make([]string, 0)
+	failures := make([]error, 0)
+	slots := make(chan struct{}, max(opts.MaxConcurrent, 1))
+
+	for _, migration := range migrations {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(migration plannedMigration) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			err := performMigration(creds, token, migration)
+			if err != nil {
+				log.Printf("Migration of %d failed: %+v\n", migration.Vm.VmNumber, err)
+
+				errLock.Lock()
+				failed = append(failed, fmt.Sprint(migration.Vm.VmNumber))
+				failures = append(failures, fmt.Errorf("migration of %d failed: %w", migration.Vm.VmNumber, err))
+				errLock.Unlock()
+			}
+		}(migration)
+	}
+
+	wg.Wait()
+
+	// Joined so callers can still get at the API and task errors underneath
+	if len(failures) > 0 {
+		return fmt.Errorf("migration failed for VMs %s\n%w", strings.Join(failed, ", "), errors.Join(failures...))
+	}
+
+	return nil
+}
+
+// planMigrations greedily moves desktops from the busiest node to the quietest one that can host them, until the gap
+// is under the threshold. canHost says whether a desktop may be moved to a node at all
+func planMigrations(resources ProxmoxVmList, states map[string]NodeState, opts RebalanceConfig, canHost func(desktop ProxmoxVm, node string) bool) []plannedMigration {
+	nodes := make([]*ProxmoxVm, 0)
+	desktops := make([]ProxmoxVm, 0)
+
+	for _, resource := range resources.Data {
+		// Nodes in maintenance are being drained by HA already, leave them to it
+		if strings.Compare(resource.Type, "node") == 0 && nodeAvailable(states, resource.Node) && resource.MaxMem > 0 {
+			node := resource
+			nodes = append(nodes, &node)
+		} else if strings.Compare(resource.Type, "qemu") == 0 && strings.Compare(resource.Status, "running") == 0 && hasVdiTag(resource) {
+			desktops = append(desktops, resource)
+		}
+	}
+
+	migrations := make([]plannedMigration, 0)
+	if len(nodes) < 2 {
+		return migrations
+	}
+
+	// Biggest desktops first, they close the gap quickest
+	slices.SortStableFunc(desktops, func(a, b ProxmoxVm) int {
+		return cmp.Compare(b.Mem, a.Mem)
+	})
+
+	for len(migrations) < opts.MaxMigrations {
+		// Quietest first, so each desktop goes to the emptiest node it's allowed on
+		slices.SortStableFunc(nodes, func(a, b *ProxmoxVm) int {
+			return cmp.Or(cmp.Compare(memoryUsage(*a), memoryUsage(*b)), strings.Compare(a.Node, b.Node))
+		})
+		busiest, quietest := nodes[len(nodes)-1], nodes[0]
+
+		if memoryUsage(*busiest)-memoryUsage(*quietest) <= *opts.Threshold {
+			break
+		}
+
+		// Find the biggest desktop on the busiest node that has somewhere to go, without just swapping which node is
+		// overloaded
+		moved := -1
+		var target *ProxmoxVm
+		for i, desktop := range desktops {
+			if strings.Compare(desktop.Node, busiest.Node) != 0 {
+				continue
+			}
+
+			for _, node := range nodes[:len(nodes)-1] {
+				if !canHost(desktop, node.Node) {
+					continue
+				}
+
+				busiestAfter := float64(busiest.Mem-desktop.Mem) / float64(busiest.MaxMem)
+				nodeAfter := float64(node.Mem+desktop.Mem) / float64(node.MaxMem)
+				if math.Abs(busiestAfter-nodeAfter) < memoryUsage(*busiest)-memoryUsage(*node) {
+					target = node
+					break
+				}
+			}
+
+			if target != nil {
+				moved = i
+				break
+			}
+		}
+
+		if moved < 0 {
+			break
+		}
+
+		desktop := desktops[moved]
+		migrations = append(migrations, plannedMigration{Vm: desktop, Target: target.Node})
+
+		busiest.Mem -= desktop.Mem
+		target.Mem += desktop.Mem
+		desktops = slices.Delete(desktops, moved, moved+1)
+	}
+
+	return migrations
+}
+
+// migrationAllowed applies the same rules to moving a desktop as placement does to creating one: the node has to
+// be allowed for the desktop's template, and every storage its disks are on has to exist there
+func migrationAllowed(resources ProxmoxVmList, storages map[int32][]string, desktop ProxmoxVm, node string) bool {
+	if template, found := desktopTemplate(resources, desktop); found {
+		allowedNodes := templateConfig(template).Nodes
+		if len(allowedNodes) > 0 && !slices.Contains(allowedNodes, node) {
+			return false
+		}
+	}
+
+	// Without the desktop's config there's no telling where its disks can go, so it stays put
+	desktopStorages, known := storages[desktop.VmNumber]
+	if !known {
+		return false
+	}
+	for _, storage := range desktopStorages {
+		if !storageAvailable(resources, node, storage) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// desktopTemplate finds the template a desktop was cloned from, going by its vdi-tpl tag
+func desktopTemplate(resources ProxmoxVmList, desktop ProxmoxVm) (ProxmoxVm, bool) {
+	for _, resource := range resources.Data {
+		if strings.Compare(resource.Type, "qemu") == 0 && hasTag(desktop, vdiTemplateTag(resource)) {
+			return resource, true
+		}
+	}
+
+	return ProxmoxVm{}, false
+}
+
+// desktopStorages reads which storages each running desktop's disks are on, keyed by VM ID
+func desktopStorages(creds ProxmoxCreds, token ProxmoxAuth, resources ProxmoxVmList) map[int32][]string {
+	storages := make(map[int32][]string)
+
+	for _, resource := range resources.Data {
+		if strings.Compare(resource.Type, "qemu") != 0 || strings.Compare(resource.Status, "running") != 0 || !hasVdiTag(resource) {
+			continue
+		}
+
+		vmConfig, err := getVmConfig(creds, token, resource)
+		if err != nil {
+			log.Printf("Couldn't read config for %d, it won't be migrated: %+v\n", resource.VmNumber, err)
+			continue
+		}
+		storages[resource.VmNumber] = diskStorages(vmConfig)
+	}
+
+	return storages
+}
+
+func performMigration(creds ProxmoxCreds, token ProxmoxAuth, migration plannedMigration) error {
+	job, err := migrateVM(creds, token, migration.Vm, migration.Target)
+	if err != nil {
+		return fmt.Errorf("error while starting migration: %w\n", err)
+	}
+
+	// Migration tasks live on the source node
+	sourceCreds := creds
+	sourceCreds.Server = migration.Vm.Node
+
+	progress := func(status ProxmoxJobStatus) {
+		log.Printf("Migration of %d to %s: %s\n", migration.Vm.VmNumber, migration.Target, status.Status)
+	}
+
+	status, err := waitForTask(context.Background(), sourceCreds, token, job, waitOptions("migration", config.Timeouts.Migrate.Duration), progress)
+	if err != nil {
+		return fmt.Errorf("error while waiting for migration: %w\n", err)
+	}
+
+	return checkTaskResult(sourceCreds, token, status, "migration")
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+const gib = int64(1 << 30)
+
+func testNode(name string, usedGib int64, status string) ProxmoxVm {
+	return ProxmoxVm{Type: "node", Node: name, Status: status, Mem: usedGib * gib, MaxMem: 100 * gib}
+}
+
+func testDesktop(vmid int32, node string, memGib int64) ProxmoxVm {
+	return ProxmoxVm{Type: "qemu", Id: fmt.Sprintf("qemu/%d", vmid), VmNumber: vmid, Node: node, Status: "running", Tags: vdiTag, Mem: memGib * gib}
+}
+
+func TestPlanMigrations(t *testing.T) {
+	anywhere := func(ProxmoxVm, string) bool { return true }
+	threshold, noThreshold := 0.2, 0.0
+	opts := RebalanceConfig{Threshold: &threshold, MaxConcurrent: 2, MaxMigrations: 10}
+
+	tests := []struct {
+		name        string
+		resources   []ProxmoxVm
+		maintenance []string
+		opts        RebalanceConfig
+		canHost     func(ProxmoxVm, string) bool
+
+		// Planned moves as "vmid->node", in order
+		want []string
+	}{
+		{
+			name:      "balanced cluster",
+			resources: []ProxmoxVm{testNode("pve1", 40, "online"), testNode("pve2", 35, "online"), testDesktop(101, "pve1", 8)},
+			opts:      opts,
+			canHost:   anywhere,
+			want:      []string{},
+		},
+		{
+			name: "biggest desktop closes the gap on its own",
+			resources: []ProxmoxVm{
+				testNode("pve1", 80, "online"), testNode("pve2", 20, "online"),
+				testDesktop(101, "pve1", 8), testDesktop(102, "pve1", 24), testDesktop(103, "pve1", 4),
+			},
+			opts:    opts,
+			canHost: anywhere,
+			want:    []string{"102->pve2"},
+		},
+		{
+			name: "desktop too big to help stays put",
+			resources: []ProxmoxVm{
+				testNode("pve1", 60, "online"), testNode("pve2", 30, "online"),
+				testDesktop(101, "pve1", 40),
+			},
+			opts:    opts,
+			canHost: anywhere,
+			want:    []string{},
+		},
+		{
+			name: "only VDI desktops are moved",
+			resources: []ProxmoxVm{
+				testNode("pve1", 80, "online"), testNode("pve2", 20, "online"),
+				{Type: "qemu", VmNumber: 200, Node: "pve1", Status: "running", Mem: 24 * gib},
+				testDesktop(101, "pve1", 8),
+			},
+			opts:    opts,
+			canHost: anywhere,
+			want:    []string{"101->pve2"},
+		},
+		{
+			name: "stopped desktops are left alone",
+			resources: []ProxmoxVm{
+				testNode("pve1", 80, "online"), testNode("pve2", 20, "online"),
+				{Type: "qemu", VmNumber: 101, Node: "pve1", Status: "stopped", Tags: vdiTag, Mem: 24 * gib},
+			},
+			opts:    opts,
+			canHost: anywhere,
+			want:    []string{},
+		},
+		{
+			name: "offline and maintenance nodes take nothing",
+			resources: []ProxmoxVm{
+				testNode("pve1", 80, "online"), testNode("pve2", 0, "offline"), testNode("pve3", 10, "online"),
+				testDesktop(101, "pve1", 24),
+			},
+			maintenance: []string{"pve3"},
+			opts:        opts,
+			canHost:     anywhere,
+			want:        []string{},
+		},
+		{
+			name: "disallowed node is skipped for the next quietest",
+			resources: []ProxmoxVm{
+				testNode("pve1", 80, "online"), testNode("pve2", 10, "online"), testNode("pve3", 30, "online"),
+				testDesktop(101, "pve1", 24),
+			},
+			opts: opts,
+			canHost: func(desktop ProxmoxVm, node string) bool {
+				return node != "pve2"
+			},
+			want: []string{"101->pve3"},
+		},
+		{
+			name: "desktop with nowhere to go makes way for one that has",
+			resources: []ProxmoxVm{
+				testNode("pve1", 80, "online"), testNode("pve2", 20, "online"),
+				testDesktop(101, "pve1", 24), testDesktop(102, "pve1", 16),
+			},
+			opts: opts,
+			canHost: func(desktop ProxmoxVm, node string) bool {
+				return desktop.VmNumber != 101
+			},
+			want: []string{"102->pve2"},
+		},
+		{
+			name: "migration limit",
+			resources: []ProxmoxVm{
+				testNode("pve1", 90, "online"), testNode("pve2", 10, "online"),
+				testDesktop(101, "pve1", 10), testDesktop(102, "pve1", 10), testDesktop(103, "pve1", 10),
+			},
+			opts:    RebalanceConfig{Threshold: &threshold, MaxConcurrent: 2, MaxMigrations: 1},
+			canHost: anywhere,
+			want:    []string{"101->pve2"},
+		},
+		{
+			name: "zero threshold keeps going while it helps",
+			resources: []ProxmoxVm{
+				testNode("pve1", 80, "online"), testNode("pve2", 20, "online"),
+				testDesktop(101, "pve1", 8), testDesktop(102, "pve1", 24), testDesktop(103, "pve1", 4),
+			},
+			opts:    RebalanceConfig{Threshold: &noThreshold, MaxConcurrent: 2, MaxMigrations: 10},
+			canHost: anywhere,
+			want:    []string{"102->pve2", "101->pve2"},
+		},
+		{
+			name:      "single node",
+			resources: []ProxmoxVm{testNode("pve1", 90, "online"), testDesktop(101, "pve1", 10)},
+			opts:      opts,
+			canHost:   anywhere,
+			want:      []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resources := ProxmoxVmList{Data: test.resources}
+			states := resourceNodeStates(resources)
+			for _, node := range test.maintenance {
+				state := states[node]
+				state.Maintenance = true
+				states[node] = state
+			}
+
+			got := make([]string, 0)
+			for _, migration := range planMigrations(resources, states, test.opts, test.canHost) {
+				got = append(got, fmt.Sprintf("%d->%s", migration.Vm.VmNumber, migration.Target))
+			}
+
+			if !slices.Equal(got, test.want) {
+				t.Errorf("planMigrations() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMigrationAllowed(t *testing.T) {
+	allowedNodes := []string{"pve1", "pve3"}
+	config = VdiConfig{Templates: map[string]TemplateConfig{"900": {Nodes: allowedNodes}}}
+	t.Cleanup(func() { config = VdiConfig{} })
+
+	template := ProxmoxVm{Type: "qemu", VmNumber: 900, Node: "pve1", Template: 1}
+	storage := func(node string, name string, status string) ProxmoxVm {
+		return ProxmoxVm{Type: "storage", Node: node, Storage: name, Status: status}
+	}
+	resources := ProxmoxVmList{Data: []ProxmoxVm{
+		template,
+		storage("pve1", "local-lvm", "available"),
+		storage("pve2", "local-lvm", "available"),
+		storage("pve3", "local-lvm", "available"),
+		storage("pve4", "local-lvm", "available"),
+		storage("pve4", "fast", "available"),
+		storage("pve5", "local-lvm", "unavailable"),
+	}}
+
+	cloned := testDesktop(101, "pve1", 8)
+	cloned.Tags = fmt.Sprintf("%s;%s", vdiTag, vdiTemplateTag(template))
+	untracked := testDesktop(102, "pve1", 8)
+
+	storages := map[int32][]string{101: {"local-lvm"}, 102: {"local-lvm", "fast"}, 103: {"local-lvm"}}
+
+	tests := []struct {
+		name    string
+		desktop ProxmoxVm
+		node    string
+		want    bool
+	}{
+		{"node allowed for the template", cloned, "pve3", true},
+		{"node excluded by the template", cloned, "pve2", false},
+		{"no template, any node with the storage", untracked, "pve4", true},
+		{"storage missing on the target", untracked, "pve2", false},
+		{"storage unavailable on the target", testDesktop(103, "pve1", 8), "pve5", false},
+		{"unknown disks stay put", testDesktop(104, "pve1", 8), "pve4", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := migrationAllowed(resources, storages, test.desktop, test.node); got != test.want {
+				t.Errorf("migrationAllowed(%d, %s) = %v, want %v", test.desktop.VmNumber, test.node, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// SizePreset is a hardware size clones of a template can be given, such as small, medium or large. Anything left
+// out keeps the template's value
+type SizePreset struct {
+	Cores int `json:"cores,omitempty"`
+
+	// Memory in MiB
+	Memory int `json:"memory,omitempty"`
+
+	// Memory the balloon driver may shrink the desktop down to, in MiB. Zero turns ballooning off
+	Balloon *int `json:"balloon,omitempty"`
+
+	// Disk to grow, such as scsi0, and the size to grow it to, such as 64G, or by, such as +20G. PVE can only grow
+	// disks, never shrink them
+	Disk     string `json:"disk,omitempty"`
+	DiskSize string `json:"disk_size,omitempty"`
+
+	// Users allowed this size, such as jsmith@pve. Empty means everyone
+	Users []string `json:"users,omitempty"`
+}
+
+// What the template's own hardware is called in the picker, when it's one of the choices
+const templateSizeLabel = "Standard"
+
+var diskSizePattern = regexp.MustCompile(`^\+?\d+(\.\d+)?[KMGT]?$`)
+
+func validateSizes(templateCfg TemplateConfig) error {
+	for name, preset := range templateCfg.Sizes {
+		if name == "" {
+			return fmt.Errorf("size presets need a name\n")
+		}
+		if preset.Cores < 0 || preset.Memory < 0 || (preset.Balloon != nil && *preset.Balloon < 0) {
+			return fmt.Errorf("size %s can't have negative cores or memory\n", name)
+		}
+		if preset.Balloon != nil && preset.Memory > 0 && *preset.Balloon > preset.Memory {
+			return fmt.Errorf("size %s has a balloon bigger than its memory\n", name)
+		}
+		if preset.DiskSize != "" && preset.Disk == "" {
+			return fmt.Errorf("size %s needs a disk to resize\n", name)
+		}
+		if preset.DiskSize != "" && !diskSizePattern.MatchString(preset.DiskSize) {
+			return fmt.Errorf("size %s has an invalid disk size %s, use something like 64G or +20G\n", name, preset.DiskSize)
+		}
+	}
+
+	if templateCfg.DefaultSize != "" {
+		if _, exists := templateCfg.Sizes[templateCfg.DefaultSize]; !exists {
+			return fmt.Errorf("default size %s isn't one of the sizes\n", templateCfg.DefaultSize)
+		}
+	}
+
+	return nil
+}
+
+func (preset SizePreset) Allows(username string) bool {
+	if len(preset.Users) == 0 {
+		return true
+	}
+
+	for _, user := range preset.Users {
+		if strings.Compare(user, username) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// availableSizes lists the sizes username may pick for template, smallest first, with the one they get by default
+// first of all. An empty name means the template's own hardware. Templates without sizes have no choices at all
+func availableSizes(template ProxmoxVm, username string) []string {
+	templateCfg := templateConfig(template)
+	if len(templateCfg.Sizes) == 0 {
+		return nil
+	}
+
+	sizes := make([]string, 0, len(templateCfg.Sizes)+1)
+	for _, name := range slices.Sorted(maps.Keys(templateCfg.Sizes)) {
+		if templateCfg.Sizes[name].Allows(username) && strings.Compare(name, templateCfg.DefaultSize) != 0 {
+			sizes = append(sizes, name)
+		}
+	}
+	slices.SortStableFunc(sizes, func(a, b string) int {
+		return cmp.Or(cmp.Compare(templateCfg.Sizes[a].Memory, templateCfg.Sizes[b].Memory), cmp.Compare(templateCfg.Sizes[a].Cores, templateCfg.Sizes[b].Cores))
+	})
+
+	// Everyone gets the default, whether or not they're listed against it
+	return append([]string{templateCfg.DefaultSize}, sizes...)
+}
+
+// resolveSize checks username is allowed the size they asked for. An empty size means the template's default
+func resolveSize(template ProxmoxVm, username string, size string) (SizePreset, error) {
+	templateCfg := templateConfig(template)
+	if size == "" {
+		size = templateCfg.DefaultSize
+	}
+	if size == "" {
+		return SizePreset{}, nil
+	}
+
+	preset, exists := templateCfg.Sizes[size]
+	if !exists {
+		return SizePreset{}, fmt.Errorf("%s has no size called %s\n", template.Name, size)
+	}
+
+	if strings.Compare(size, templateCfg.DefaultSize) != 0 && !preset.Allows(username) {
+		return SizePreset{}, fmt.Errorf("%s isn't allowed the %s size of %s\n", username, size, template.Name)
+	}
+
+	return preset, nil
+}
+
+// applySize gives the clone the preset's hardware. The clone mustn't have started yet, PVE only applies most of
+// this on the next boot
+func applySize(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, clone ProxmoxVm, preset SizePreset, progress ConnectProgress) error {
+	data := url.Values{}
+	if preset.Cores > 0 {
+		data.Set("cores", fmt.Sprint(preset.Cores))
+	}
+	if preset.Memory > 0 {
+		data.Set("memory", fmt.Sprint(preset.Memory))
+	}
+	if preset.Balloon != nil {
+		data.Set("balloon", fmt.Sprint(*preset.Balloon))
+	}
+
+	if len(data) > 0 {
+		err := setVmConfig(creds, token, clone, data)
+		if err != nil {
+			return fmt.Errorf("error while setting the desktop's CPU and memory: %w\n", err)
+		}
+	}
+
+	if preset.DiskSize == "" {
+		return nil
+	}
+
+	log.Printf("Resizing %s on %d to %s\n", preset.Disk, clone.VmNumber, preset.DiskSize)
+	job, err := resizeDisk(creds, token, clone, preset.Disk, preset.DiskSize)
+	if err != nil {
+		return fmt.Errorf("error while resizing %s: %w\n", preset.Disk, err)
+	}
+
+	// Older PVE versions resize there and then rather than starting a task
+	if job.JobId == "" {
+		return nil
+	}
+
+	_, err = followJob(ctx, creds, token, job, waitOptions("disk resize", config.Timeouts.Clone.Duration), progress)
+	return err
+}
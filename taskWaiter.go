@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+type WaitOptions struct {
+	// What we're waiting for, used in error messages
+	Phase string
+
+	// Delay before the first re-check, doubled (by Multiplier) up to MaxInterval after every attempt
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+
+	// Fraction of each delay that's randomised, so a room full of thin clients doesn't poll in lockstep
+	Jitter float64
+
+	// Deadline for this phase alone. Zero means only the context's deadline applies
+	Timeout time.Duration
+}
+
+// errPhaseTimeout is returned, wrapped, when a single phase runs over its own deadline
+var errPhaseTimeout = errors.New("timed out")
+
+func waitOptions(phase string, timeout time.Duration) WaitOptions {
+	return WaitOptions{
+		Phase:           phase,
+		InitialInterval: 500 * time.Millisecond,
+		MaxInterval:     10 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.2,
+		Timeout:         timeout,
+	}
+}
+
+// backoffPoll calls check until it reports done, sleeping with exponential backoff and jitter in between. It gives
+// up when check fails, the phase times out, or ctx is done
+func backoffPoll(ctx context.Context, opts WaitOptions, check func() (bool, error)) error {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Timeout, fmt.Errorf("%w waiting for %s after %s", errPhaseTimeout, opts.Phase, opts.Timeout))
+		defer cancel()
+	}
+
+	interval := opts.InitialInterval
+	for {
+		done, err := check()
+		if err != nil {
+			return err
+		} else if done {
+			return nil
+		}
+
+		delay := interval
+		if opts.Jitter > 0 {
+			delay += time.Duration((rand.Float64()*2 - 1) * opts.Jitter * float64(interval))
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			// Report our own phase timeout rather than a bare "deadline exceeded"
+			if cause := context.Cause(ctx); errors.Is(cause, errPhaseTimeout) {
+				return cause
+			}
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		interval = min(time.Duration(float64(interval)*opts.Multiplier), opts.MaxInterval)
+	}
+}
+
+// waitForTask polls a PVE task until it stops, calling onPoll (if set) with every status seen
+func waitForTask(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, job ProxmoxJobStatus, opts WaitOptions, onPoll func(ProxmoxJobStatus)) (ProxmoxJobStatus, error) {
+	var final ProxmoxJobStatus
+
+	err := backoffPoll(ctx, opts, func() (bool, error) {
+		jobStatus, err := getJobStatus(creds, token, job)
+		if err != nil {
+			return false, fmt.Errorf("error while getting job status: %w\n", err)
+		}
+
+		if onPoll != nil {
+			onPoll(jobStatus)
+		}
+
+		final = jobStatus
+		return strings.Compare(jobStatus.Status, "stopped") == 0, nil
+	})
+
+	return final, err
+}
+
+// TaskFailedError describes a PVE task that ran to completion but didn't succeed
+type TaskFailedError struct {
+	Phase      string
+	Job        ProxmoxJobStatus
+	ExitStatus string
+
+	// The last few lines of the task log, which is where PVE puts the actual reason
+	LogTail []string
+}
+
+func (err *TaskFailedError) Error() string {
+	if len(err.LogTail) == 0 {
+		return fmt.Sprintf("%s failed: %s\n", err.Phase, err.ExitStatus)
+	}
+
+	return fmt.Sprintf("%s failed: %s\n%s\n", err.Phase, err.ExitStatus, strings.Join(err.LogTail, "\n"))
+}
+
+// How many lines of the log end up in a TaskFailedError
+const taskLogTailLines = 10
+
+// taskSucceeded reports whether a stopped task finished successfully. Warnings don't count as failure
+func taskSucceeded(job ProxmoxJobStatus) bool {
+	return strings.Compare(job.Exitstatus, "OK") == 0 || strings.HasPrefix(job.Exitstatus, "WARNINGS")
+}
+
+// checkTaskResult turns a finished task into a TaskFailedError if it didn't succeed
+func checkTaskResult(creds ProxmoxCreds, token ProxmoxAuth, job ProxmoxJobStatus, phase string) error {
+	if taskSucceeded(job) {
+		return nil
+	}
+
+	failure := &TaskFailedError{Phase: phase, Job: job, ExitStatus: job.Exitstatus}
+
+	// The log comes back a page at a time and it's the end we're interested in
+	lines := make([]ProxmoxTaskLogLine, 0)
+	for {
+		page, err := getJobLog(creds, token, job, len(lines))
+		if err != nil {
+			log.Printf("Couldn't read log for failed task %s: %+v\n", job.JobId, err)
+			break
+		}
+
+		lines = append(lines, page...)
+		if len(page) < taskLogPageSize {
+			break
+		}
+	}
+
+	for _, line := range lines[max(len(lines)-taskLogTailLines, 0):] {
+		if strings.Compare(line.Text, "no content") != 0 {
+			failure.LogTail = append(failure.LogTail, line.Text)
+		}
+	}
+
+	return failure
+}
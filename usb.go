@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UsbPolicy decides which USB devices the user can redirect to their desktop. One can be set for the whole client
+// and another per template, the template's rules are checked first
+type UsbPolicy struct {
+	// Turn USB redirection off altogether
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Redirect allowed devices as soon as the viewer connects, rather than waiting for the user to pick them
+	AutoRedirect bool `json:"auto_redirect,omitempty"`
+
+	// Checked in order, the first rule to match a device decides. Devices no rule matches are allowed
+	Rules []UsbRule `json:"rules,omitempty"`
+
+	// Leave out defaultUsbRules, so keyboards, mice and hubs can be redirected like anything else
+	NoDefaultRules bool `json:"no_default_rules,omitempty"`
+}
+
+// UsbRule matches devices by class, vendor, product and version. Anything left empty matches every device
+type UsbRule struct {
+	// Either a USB class code such as 0x03, or one of the names in usbClasses
+	Class   string `json:"class,omitempty"`
+	Vendor  string `json:"vendor,omitempty"`
+	Product string `json:"product,omitempty"`
+
+	// Device release number, such as 0x0100 for 1.00
+	Version string `json:"version,omitempty"`
+
+	Allow bool `json:"allow"`
+}
+
+var usbClasses = map[string]int{
+	"audio":     0x01,
+	"comm":      0x02,
+	"hid":       0x03,
+	"printer":   0x07,
+	"storage":   0x08,
+	"hub":       0x09,
+	"smartcard": 0x0b,
+	"video":     0x0e,
+	"wireless":  0xe0,
+	"vendor":    0xff,
+}
+
+// Keyboards and mice belong to the thin client, and redirecting a hub takes everything plugged into it too. These
+// go after any configured rules, so an allow rule for one device doesn't let everything else through
+var defaultUsbRules = []UsbRule{
+	{Class: "hid", Allow: false},
+	{Class: "hub", Allow: false},
+}
+
+// usbPolicy combines the client's policy with the template's
+func usbPolicy(template ProxmoxVm) UsbPolicy {
+	templatePolicy := templateConfig(template).Usb
+
+	policy := UsbPolicy{
+		Disabled:       config.Usb.Disabled || templatePolicy.Disabled,
+		AutoRedirect:   config.Usb.AutoRedirect || templatePolicy.AutoRedirect,
+		NoDefaultRules: config.Usb.NoDefaultRules || templatePolicy.NoDefaultRules,
+	}
+	policy.Rules = append(policy.Rules, templatePolicy.Rules...)
+	policy.Rules = append(policy.Rules, config.Usb.Rules...)
+
+	if !policy.NoDefaultRules {
+		policy.Rules = append(policy.Rules, defaultUsbRules...)
+	}
+
+	return policy
+}
+
+// Filter renders the rules in usbredir's filter syntax: class,vendor,product,version,allow with -1 as a wildcard,
+// one rule per |. usbredir refuses anything no rule matches, so a catch-all allow goes on the end
+func (policy UsbPolicy) Filter() (string, error) {
+	rules := make([]string, 0, len(policy.Rules)+1)
+
+	for _, rule := range policy.Rules {
+		rendered, err := rule.filter()
+		if err != nil {
+			return "", err
+		}
+		rules = append(rules, rendered)
+	}
+
+	rules = append(rules, "-1,-1,-1,-1,1")
+	return strings.Join(rules, "|"), nil
+}
+
+// ViewerArgs renders the policy as remote-viewer command line options
+func (policy UsbPolicy) ViewerArgs() ([]string, error) {
+	if policy.Disabled {
+		return []string{"--spice-disable-usbredir"}, nil
+	}
+
+	filter, err := policy.Filter()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{fmt.Sprintf("--spice-usbredir-auto-redirect-filter=%s", filter)}
+	if policy.AutoRedirect {
+		args = append(args, fmt.Sprintf("--spice-usbredir-redirect-on-connect=%s", filter))
+	}
+
+	return args, nil
+}
+
+// ApplyTo renders the policy into the [virt-viewer] section of a connection file
+func (policy UsbPolicy) ApplyTo(file *VirtViewerFile) error {
+	if policy.Disabled {
+		file.Set("enable-usbredir", "0")
+		file.Set("enable-usb-autoshare", "0")
+		return nil
+	}
+
+	filter, err := policy.Filter()
+	if err != nil {
+		return err
+	}
+
+	file.Set("enable-usbredir", "1")
+	file.Set("usb-filter", filter)
+	if policy.AutoRedirect {
+		file.Set("enable-usb-autoshare", "1")
+	} else {
+		file.Set("enable-usb-autoshare", "0")
+	}
+
+	return nil
+}
+
+func (rule UsbRule) filter() (string, error) {
+	class, err := parseUsbClass(rule.Class)
+	if err != nil {
+		return "", err
+	}
+
+	fields := []string{class}
+	for _, field := range []struct{ name, value string }{{"vendor", rule.Vendor}, {"product", rule.Product}, {"version", rule.Version}} {
+		value, err := parseUsbId(field.name, field.value)
+		if err != nil {
+			return "", err
+		}
+		fields = append(fields, value)
+	}
+
+	if rule.Allow {
+		fields = append(fields, "1")
+	} else {
+		fields = append(fields, "0")
+	}
+
+	return strings.Join(fields, ","), nil
+}
+
+// parseUsbClass normalises a class name or code to hex. Classes are a single byte, unlike the other IDs
+func parseUsbClass(class string) (string, error) {
+	if code, exists := usbClasses[strings.ToLower(strings.TrimSpace(class))]; exists {
+		return fmt.Sprintf("0x%02x", code), nil
+	}
+
+	return parseUsbHex("class", class, 8)
+}
+
+// parseUsbId normalises a 16-bit USB ID to hex, treating empty, "*" and "any" as the -1 wildcard
+func parseUsbId(name string, id string) (string, error) {
+	return parseUsbHex(name, id, 16)
+}
+
+func parseUsbHex(name string, id string, bits int) (string, error) {
+	id = strings.TrimSpace(id)
+	switch strings.ToLower(id) {
+	case "", "*", "any", "-1":
+		return "-1", nil
+	}
+
+	value, err := strconv.ParseUint(id, 0, bits)
+	if err != nil {
+		return "", fmt.Errorf("invalid USB %s %q: %+v\n", name, id, err)
+	}
+
+	return fmt.Sprintf("0x%0*x", bits/4, value), nil
+}
+
+func validateUsbPolicy(policy UsbPolicy) error {
+	_, err := policy.Filter()
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestUsbPolicyFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []UsbRule
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "no rules allows everything",
+			want: "-1,-1,-1,-1,1",
+		},
+		{
+			name:  "class by name",
+			rules: []UsbRule{{Class: "storage", Allow: false}},
+			want:  "0x08,-1,-1,-1,0|-1,-1,-1,-1,1",
+		},
+		{
+			name:  "class names ignore case and spaces",
+			rules: []UsbRule{{Class: " SmartCard ", Allow: true}},
+			want:  "0x0b,-1,-1,-1,1|-1,-1,-1,-1,1",
+		},
+		{
+			name:  "numeric ids in hex and decimal",
+			rules: []UsbRule{{Class: "0x03", Vendor: "0x046d", Product: "49948", Version: "0x0100", Allow: true}},
+			want:  "0x03,0x046d,0xc31c,0x0100,1|-1,-1,-1,-1,1",
+		},
+		{
+			name: "wildcards",
+			rules: []UsbRule{
+				{Class: "*", Vendor: "any", Product: "-1", Allow: true},
+				{Class: "ANY", Vendor: "", Allow: false},
+			},
+			want: "-1,-1,-1,-1,1|-1,-1,-1,-1,0|-1,-1,-1,-1,1",
+		},
+		{
+			name:  "rules keep their order",
+			rules: []UsbRule{{Vendor: "0x1050", Allow: true}, {Class: "hid", Allow: false}},
+			want:  "-1,0x1050,-1,-1,1|0x03,-1,-1,-1,0|-1,-1,-1,-1,1",
+		},
+		{
+			name:    "unknown class name",
+			rules:   []UsbRule{{Class: "webcam"}},
+			wantErr: true,
+		},
+		{
+			name:  "numeric class matches its name",
+			rules: []UsbRule{{Class: "11", Allow: true}, {Class: "smartcard", Allow: true}},
+			want:  "0x0b,-1,-1,-1,1|0x0b,-1,-1,-1,1|-1,-1,-1,-1,1",
+		},
+		{
+			name:    "class wider than 8 bits",
+			rules:   []UsbRule{{Class: "0x0103"}},
+			wantErr: true,
+		},
+		{
+			name:    "id wider than 16 bits",
+			rules:   []UsbRule{{Vendor: "0x10000"}},
+			wantErr: true,
+		},
+		{
+			name:    "negative id",
+			rules:   []UsbRule{{Product: "-2"}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := UsbPolicy{Rules: test.rules}.Filter()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Filter() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("Filter() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUsbPolicyMerge(t *testing.T) {
+	template := ProxmoxVm{Type: "qemu", VmNumber: 900}
+	yubikey := UsbRule{Vendor: "0x1050", Allow: true}
+	storage := UsbRule{Class: "storage", Allow: false}
+
+	tests := []struct {
+		name     string
+		client   UsbPolicy
+		template UsbPolicy
+		want     []UsbRule
+	}{
+		{
+			name: "defaults on their own",
+			want: defaultUsbRules,
+		},
+		{
+			name:     "template rules, then client rules, then defaults",
+			client:   UsbPolicy{Rules: []UsbRule{storage}},
+			template: UsbPolicy{Rules: []UsbRule{yubikey}},
+			want:     append([]UsbRule{yubikey, storage}, defaultUsbRules...),
+		},
+		{
+			name:   "client opts out of the defaults",
+			client: UsbPolicy{Rules: []UsbRule{storage}, NoDefaultRules: true},
+			want:   []UsbRule{storage},
+		},
+		{
+			name:     "template opts out of the defaults",
+			template: UsbPolicy{Rules: []UsbRule{yubikey}, NoDefaultRules: true},
+			want:     []UsbRule{yubikey},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config = VdiConfig{Usb: test.client, Templates: map[string]TemplateConfig{"900": {Usb: test.template}}}
+			t.Cleanup(func() { config = VdiConfig{} })
+
+			if got := usbPolicy(template).Rules; !slices.Equal(got, test.want) {
+				t.Errorf("usbPolicy().Rules = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
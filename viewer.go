@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+const (
+	ViewerRemoteViewer = "remote-viewer"
+	ViewerSpicy        = "spicy"
+	ViewerCommand      = "command"
+	ViewerDryRun       = "dry-run"
+)
+
+type ViewerConfig struct {
+	// Which viewer to use, see the Viewer* constants. Defaults to remote-viewer
+	Type string `json:"type,omitempty"`
+
+	// Path to the viewer's binary, if it's not on the PATH under its usual name
+	Path string `json:"path,omitempty"`
+
+	// For the "command" viewer, the command line to run. Each argument is a text/template, see ViewerTemplateData
+	Command []string `json:"command,omitempty"`
+
+	// Extra arguments, added after ours. A template's are added after the client's
+	Args []string `json:"args,omitempty"`
+
+	// Extra environment variables for the viewer
+	Env map[string]string `json:"env,omitempty"`
+
+	// spicy can only take the SPICE ticket on its command line, where any other user on the client can read it
+	// with ps. It refuses to run unless this is set, and never runs in kiosk mode
+	AllowTicketOnCommandLine bool `json:"allow_ticket_on_command_line,omitempty"`
+}
+
+// Viewer shows the user their desktop
+type Viewer interface {
+	// Launch blocks until the user is finished with the desktop
+	Launch(session ViewerSession) error
+}
+
+// ViewerSession is everything a viewer needs to connect to one desktop
+type ViewerSession struct {
+	Template       ProxmoxVm
+	ConnectionFile *VirtViewerFile
+	Config         ViewerConfig
+}
+
+// ViewerTemplateData is what the "command" viewer's arguments can refer to, such as {{.Host}}
+type ViewerTemplateData struct {
+	// Path to the .vv file, or "-" when it's passed on stdin
+	File string
+
+	Host     string
+	Port     string
+	TlsPort  string
+	Password string
+	Proxy    string
+	Title    string
+
+	// Name of the desktop the user picked
+	Name  string
+	Kiosk bool
+}
+
+func validViewer(viewer string) bool {
+	switch viewer {
+	case ViewerRemoteViewer, ViewerSpicy, ViewerCommand, ViewerDryRun:
+		return true
+	default:
+		return false
+	}
+}
+
+// viewerConfig merges the template's viewer settings over the client's
+func viewerConfig(template ProxmoxVm) ViewerConfig {
+	settings := config.Viewer
+	override := templateConfig(template).Viewer
+
+	if override.Type != "" {
+		settings.Type = override.Type
+	}
+	if override.Path != "" {
+		settings.Path = override.Path
+	}
+	if len(override.Command) > 0 {
+		settings.Command = override.Command
+	}
+	if override.AllowTicketOnCommandLine {
+		settings.AllowTicketOnCommandLine = true
+	}
+	settings.Args = append(append([]string{}, settings.Args...), override.Args...)
+
+	settings.Env = maps.Clone(settings.Env)
+	if settings.Env == nil {
+		settings.Env = make(map[string]string)
+	}
+	maps.Copy(settings.Env, override.Env)
+
+	return settings
+}
+
+func newViewer(viewerType string) Viewer {
+	switch viewerType {
+	case ViewerSpicy:
+		return spicyViewer{}
+	case ViewerCommand:
+		return commandViewer{}
+	case ViewerDryRun:
+		return dryRunViewer{}
+	default:
+		return remoteViewer{}
+	}
+}
+
+// launchViewer shows the user the desktop described by connectionFile and waits until they're done with it
+func launchViewer(template ProxmoxVm, connectionFile *VirtViewerFile) error {
+	session := ViewerSession{
+		Template:       template,
+		ConnectionFile: connectionFile,
+		Config:         viewerConfig(template),
+	}
+
+	return newViewer(session.Config.Type).Launch(session)
+}
+
+type remoteViewer struct{}
+
+func (remoteViewer) Launch(session ViewerSession) error {
+	vdiArgs, err := remoteViewerArgs(session)
+	if err != nil {
+		return err
+	}
+
+	// The file holds a login ticket, so it either never touches the disk or only stays there while it's needed
+	var stdin io.Reader
+	if connectionFileSettings(session.Template).Stdin {
+		vdiArgs = append(vdiArgs, "-")
+		stdin = bytes.NewReader(session.ConnectionFile.Bytes())
+	} else {
+		filename, err := writeConnectionFile(session.ConnectionFile.Bytes(), "*.vv")
+		if err != nil {
+			return err
+		}
+		defer removeConnectionFile(filename)
+
+		vdiArgs = append(vdiArgs, filename)
+	}
+
+	return runViewer(session.Config, ViewerRemoteViewer, vdiArgs, stdin)
+}
+
+// remoteViewerArgs is remote-viewer's command line, apart from the connection file itself
+func remoteViewerArgs(session ViewerSession) ([]string, error) {
+	vdiArgs := make([]string, 0)
+
+	// Redirect USB rules, the connection file has them too but older viewers only look at the command line
+	if strings.Compare(session.ConnectionFile.Get("type"), "spice") == 0 {
+		usbArgs, err := usbPolicy(session.Template).ViewerArgs()
+		if err != nil {
+			return nil, fmt.Errorf("error while building USB redirect rules: %w\n", err)
+		}
+		vdiArgs = append(vdiArgs, usbArgs...)
+		vdiArgs = append(vdiArgs, config.Monitors.ViewerArgs()...)
+	}
+
+	if config.Kiosk.Enabled {
+		// Kiosk mode - Don't allow user to configure anything, and hand back to us as soon as they disconnect
+		vdiArgs = append(vdiArgs, "-k", "--kiosk-quit", "on-disconnect")
+	} else {
+		// Full screen, but allow user to configure
+		vdiArgs = append(vdiArgs, "-f")
+	}
+
+	return append(vdiArgs, session.Config.Args...), nil
+}
+
+// spicy doesn't read .vv files, so everything in it has to go on the command line instead
+type spicyViewer struct{}
+
+func (spicyViewer) Launch(session ViewerSession) error {
+	file := session.ConnectionFile
+	if strings.Compare(file.Get("type"), "spice") != 0 {
+		return fmt.Errorf("spicy can't show a %s desktop, use remote-viewer instead\n", file.Get("type"))
+	}
+
+	// Shared thin clients are exactly where someone else could be watching the process list
+	if config.Kiosk.Enabled {
+		return errors.New("spicy would expose the SPICE ticket on the command line, so it can't be used in kiosk mode\n")
+	} else if !session.Config.AllowTicketOnCommandLine {
+		return errors.New("spicy would expose the SPICE ticket on the command line, set allow_ticket_on_command_line to use it anyway\n")
+	}
+
+	usbArgs, err := usbPolicy(session.Template).ViewerArgs()
+	if err != nil {
+		return fmt.Errorf("error while building USB redirect rules: %w\n", err)
+	}
+
+	// spicy has no way to take the password other than the command line
+	spicyArgs := []string{"-h", file.Get("host"), "-w", file.Get("password"), "-f"}
+	if file.Get("port") != "" {
+		spicyArgs = append(spicyArgs, "-p", file.Get("port"))
+	}
+	if file.Get("tls-port") != "" {
+		spicyArgs = append(spicyArgs, "-s", file.Get("tls-port"))
+	}
+	if file.Get("host-subject") != "" {
+		spicyArgs = append(spicyArgs, fmt.Sprintf("--spice-host-subject=%s", file.Get("host-subject")))
+	}
+
+	// The CA is stored with its newlines escaped
+	if ca := file.Get("ca"); ca != "" {
+		caFile, err := writeConnectionFile([]byte(strings.ReplaceAll(ca, `\n`, "\n")), "*.pem")
+		if err != nil {
+			return err
+		}
+		defer removeConnectionFile(caFile)
+
+		spicyArgs = append(spicyArgs, fmt.Sprintf("--spice-ca-file=%s", caFile))
+	}
+
+	spicyArgs = append(spicyArgs, usbArgs...)
+	spicyArgs = append(spicyArgs, session.Config.Args...)
+
+	// The proxy can only be given through the environment
+	if proxy := file.Get("proxy"); proxy != "" {
+		session.Config.Env["SPICE_PROXY"] = proxy
+	}
+
+	return runViewer(session.Config, ViewerSpicy, spicyArgs, nil)
+}
+
+// commandViewer runs whatever command line the config gives it
+type commandViewer struct{}
+
+func (commandViewer) Launch(session ViewerSession) error {
+	if len(session.Config.Command) == 0 {
+		return errors.New("the command viewer needs a command\n")
+	}
+
+	data := viewerTemplateData(session)
+
+	var stdin io.Reader
+	if connectionFileSettings(session.Template).Stdin {
+		data.File = "-"
+		stdin = bytes.NewReader(session.ConnectionFile.Bytes())
+	} else {
+		filename, err := writeConnectionFile(session.ConnectionFile.Bytes(), "*.vv")
+		if err != nil {
+			return err
+		}
+		defer removeConnectionFile(filename)
+
+		data.File = filename
+	}
+
+	command, err := renderArgs(session.Config.Command, data)
+	if err != nil {
+		return err
+	}
+	if len(command) == 0 {
+		return errors.New("the command viewer's command is empty once filled in\n")
+	}
+
+	// The binary comes from the command itself, so Path doesn't apply
+	session.Config.Path = ""
+	return runViewer(session.Config, command[0], append(command[1:], session.Config.Args...), stdin)
+}
+
+// renderArgs fills in a command line where each argument is a text/template. Arguments that come out empty are
+// dropped, so optional ones can be wrapped in {{if}}
+func renderArgs(args []string, data interface{}) ([]string, error) {
+	rendered := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		argTemplate, err := template.New("arg").Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing argument %q: %+v\n", arg, err)
+		}
+
+		var out strings.Builder
+		err = argTemplate.Execute(&out, data)
+		if err != nil {
+			return nil, fmt.Errorf("error while filling in argument %q: %+v\n", arg, err)
+		}
+
+		if out.Len() > 0 {
+			rendered = append(rendered, out.String())
+		}
+	}
+
+	return rendered, nil
+}
+
+func viewerTemplateData(session ViewerSession) ViewerTemplateData {
+	file := session.ConnectionFile
+
+	return ViewerTemplateData{
+		Host:     file.Get("host"),
+		Port:     file.Get("port"),
+		TlsPort:  file.Get("tls-port"),
+		Password: file.Get("password"),
+		Proxy:    file.Get("proxy"),
+		Title:    file.Get("title"),
+		Name:     session.Template.Name,
+		Kiosk:    config.Kiosk.Enabled,
+	}
+}
+
+// dryRunViewer prints what remote-viewer would have been given, with the ticket blanked out, for testing a config
+// without a viewer installed
+type dryRunViewer struct{}
+
+func (dryRunViewer) Launch(session ViewerSession) error {
+	vdiArgs, err := remoteViewerArgs(session)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Would run: %s %s <connection file>\n", ViewerRemoteViewer, strings.Join(vdiArgs, " "))
+	for name, value := range session.Config.Env {
+		fmt.Printf("  with %s=%s\n", name, value)
+	}
+
+	redacted, err := parseVirtViewerFile(session.ConnectionFile.Bytes())
+	if err != nil {
+		return err
+	}
+	redacted.Set("password", "********")
+	fmt.Printf("Connection file:\n%s", redacted.Bytes())
+
+	return nil
+}
+
+// runViewer runs a viewer to completion, with its output going into our log
+func runViewer(settings ViewerConfig, name string, args []string, stdin io.Reader) error {
+	if settings.Path != "" {
+		name = settings.Path
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = stdin
+
+	if errors.Is(cmd.Err, exec.ErrDot) {
+		cmd.Err = nil
+	}
+
+	cmd.Env = os.Environ()
+	for variable, value := range settings.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", variable, value))
+	}
+
+	output := &viewerLog{name: name}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err := cmd.Run()
+	output.Flush()
+
+	if err != nil {
+		if tail := output.Tail(); tail != "" {
+			return fmt.Errorf("error while executing thin client profile: %w\n%s\n", err, tail)
+		}
+		return fmt.Errorf("error while executing thin client profile: %w\n", err)
+	}
+
+	return nil
+}
+
+// How many lines of viewer output are kept for error messages
+const viewerLogTailLines = 5
+
+// viewerLog passes a viewer's output on to our log a line at a time, keeping the last few for error messages
+type viewerLog struct {
+	name    string
+	partial []byte
+	tail    []string
+}
+
+func (output *viewerLog) Write(data []byte) (int, error) {
+	output.partial = append(output.partial, data...)
+
+	for {
+		line, rest, found := bytes.Cut(output.partial, []byte("\n"))
+		if !found {
+			break
+		}
+
+		output.logLine(string(line))
+		output.partial = rest
+	}
+
+	return len(data), nil
+}
+
+// Flush logs whatever's left over that didn't end in a newline
+func (output *viewerLog) Flush() {
+	if len(output.partial) > 0 {
+		output.logLine(string(output.partial))
+		output.partial = nil
+	}
+}
+
+func (output *viewerLog) Tail() string {
+	return strings.Join(output.tail, "\n")
+}
+
+func (output *viewerLog) logLine(line string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+
+	log.Printf("%s: %s\n", output.name, line)
+
+	output.tail = append(output.tail, line)
+	if len(output.tail) > viewerLogTailLines {
+		output.tail = output.tail[1:]
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// ConnectionFileSettings are written into the .vv file on top of what PVE hands us. Empty fields leave PVE's value
+// (or remote-viewer's default) alone
+type ConnectionFileSettings struct {
+	Fullscreen *bool `json:"fullscreen,omitempty"`
+
+	// Window title, defaults to the name of the desktop the user picked rather than the clone's
+	Title string `json:"title,omitempty"`
+
+	// Hotkeys, in remote-viewer's syntax such as "ctrl+alt+end"
+	SecureAttention  string `json:"secure_attention,omitempty"`
+	ToggleFullscreen string `json:"toggle_fullscreen,omitempty"`
+	ReleaseCursor    string `json:"release_cursor,omitempty"`
+
+	// Have remote-viewer delete the file once it's read it. On unless turned off here
+	DeleteThisFile *bool `json:"delete_this_file,omitempty"`
+
+	// Hand the file to remote-viewer on stdin so it never touches the disk. Needs a viewer that understands "-"
+	Stdin bool `json:"stdin,omitempty"`
+
+	// Which client monitor each guest display goes on, such as "1:2;2:1". Defaults to the client's monitor settings
+	Monitors string `json:"monitors,omitempty"`
+
+	// Any other [virt-viewer] keys, written as is
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+// Keys remote-viewer can't connect without
+var requiredVirtViewerKeys = []string{"type", "host", "password"}
+
+// connectionFileSettings merges the template's settings over the client's
+func connectionFileSettings(template ProxmoxVm) ConnectionFileSettings {
+	settings := config.ConnectionFile
+	override := templateConfig(template).ConnectionFile
+
+	if override.Fullscreen != nil {
+		settings.Fullscreen = override.Fullscreen
+	}
+	if override.Title != "" {
+		settings.Title = override.Title
+	}
+	if override.SecureAttention != "" {
+		settings.SecureAttention = override.SecureAttention
+	}
+	if override.ToggleFullscreen != "" {
+		settings.ToggleFullscreen = override.ToggleFullscreen
+	}
+	if override.ReleaseCursor != "" {
+		settings.ReleaseCursor = override.ReleaseCursor
+	}
+	if override.DeleteThisFile != nil {
+		settings.DeleteThisFile = override.DeleteThisFile
+	}
+	if override.Stdin {
+		settings.Stdin = true
+	}
+	if override.Monitors != "" {
+		settings.Monitors = override.Monitors
+	}
+
+	settings.Extra = maps.Clone(settings.Extra)
+	if settings.Extra == nil {
+		settings.Extra = make(map[string]string)
+	}
+	maps.Copy(settings.Extra, override.Extra)
+
+	if settings.Title == "" {
+		settings.Title = template.Name
+	}
+	if settings.Monitors == "" {
+		settings.Monitors = config.Monitors.Mapping()
+	}
+
+	// The file holds a login ticket, so by default it goes as soon as remote-viewer has read it
+	if settings.DeleteThisFile == nil {
+		deleteFile := true
+		settings.DeleteThisFile = &deleteFile
+	}
+
+	// A kiosk is always fullscreen and never leaves tickets lying around
+	if config.Kiosk.Enabled {
+		enabled := true
+		settings.Fullscreen = &enabled
+		settings.DeleteThisFile = &enabled
+	}
+
+	return settings
+}
+
+// prepareConnectionFile patches the .vv file PVE gave us with our own settings for template, and checks it's
+// something remote-viewer can actually use
+func prepareConnectionFile(data []byte, template ProxmoxVm) (*VirtViewerFile, error) {
+	file, err := parseVirtViewerFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = applyConnectionFileSettings(file, template)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// applyConnectionFileSettings writes our settings for template into file, then checks it's complete
+func applyConnectionFileSettings(file *VirtViewerFile, template ProxmoxVm) error {
+	settings := connectionFileSettings(template)
+
+	// Extra keys go first so the dedicated settings win if both are given
+	for _, key := range slices.Sorted(maps.Keys(settings.Extra)) {
+		file.Set(key, settings.Extra[key])
+	}
+
+	if settings.Fullscreen != nil {
+		file.SetBool("fullscreen", *settings.Fullscreen)
+	}
+	if settings.DeleteThisFile != nil {
+		file.SetBool("delete-this-file", *settings.DeleteThisFile)
+	}
+	file.SetIfNotEmpty("title", settings.Title)
+	file.SetIfNotEmpty("secure-attention", settings.SecureAttention)
+	file.SetIfNotEmpty("toggle-fullscreen", settings.ToggleFullscreen)
+	file.SetIfNotEmpty("release-cursor", settings.ReleaseCursor)
+	file.SetIfNotEmpty("monitors", settings.Monitors)
+
+	// Set last so nothing in extra can let a kiosk user out of the viewer
+	if config.Kiosk.Enabled {
+		file.Set("kiosk", "1")
+		file.Set("kiosk-quit", "on-disconnect")
+	}
+
+	// USB redirection is a SPICE thing, VNC has nothing like it
+	if strings.Compare(file.Get("type"), "spice") == 0 {
+		err := usbPolicy(template).ApplyTo(file)
+		if err != nil {
+			return fmt.Errorf("error while applying USB policy: %+v\n", err)
+		}
+	}
+
+	return file.Validate()
+}
+
+// VirtViewerFile is a parsed .vv connection file. remote-viewer only looks at the [virt-viewer] section
+type VirtViewerFile struct {
+	keys   []string
+	values map[string]string
+}
+
+const virtViewerSection = "virt-viewer"
+
+func newVirtViewerFile() *VirtViewerFile {
+	return &VirtViewerFile{values: make(map[string]string)}
+}
+
+func parseVirtViewerFile(data []byte) (*VirtViewerFile, error) {
+	file := newVirtViewerFile()
+	section := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d of connection file isn't a key=value pair\n", lineNumber)
+		}
+
+		if strings.Compare(section, virtViewerSection) != 0 {
+			continue
+		}
+
+		key = strings.TrimSpace(key)
+		if _, exists := file.values[key]; !exists {
+			file.keys = append(file.keys, key)
+		}
+		file.values[key] = strings.TrimSpace(value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading connection file: %+v\n", err)
+	}
+
+	return file, nil
+}
+
+// Get returns the value of key, or an empty string if it isn't set
+func (file *VirtViewerFile) Get(key string) string {
+	return file.values[key]
+}
+
+// Set adds or replaces key, new keys go on the end
+func (file *VirtViewerFile) Set(key string, value string) {
+	if _, exists := file.values[key]; !exists {
+		file.keys = append(file.keys, key)
+	}
+	file.values[key] = value
+}
+
+func (file *VirtViewerFile) SetBool(key string, value bool) {
+	if value {
+		file.Set(key, "1")
+	} else {
+		file.Set(key, "0")
+	}
+}
+
+func (file *VirtViewerFile) SetIfNotEmpty(key string, value string) {
+	if value != "" {
+		file.Set(key, value)
+	}
+}
+
+// Validate checks the file has everything remote-viewer needs to connect
+func (file *VirtViewerFile) Validate() error {
+	missing := make([]string, 0)
+	for _, key := range requiredVirtViewerKeys {
+		if file.Get(key) == "" {
+			missing = append(missing, key)
+		}
+	}
+
+	if file.Get("port") == "" && file.Get("tls-port") == "" {
+		missing = append(missing, "port or tls-port")
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("connection file is missing %s\n", strings.Join(missing, ", "))
+	}
+
+	switch file.Get("type") {
+	case "spice", "vnc":
+	default:
+		return fmt.Errorf("connection file is for %s, which we can't connect to\n", file.Get("type"))
+	}
+
+	return nil
+}
+
+// Bytes writes the file back out in the same order it was read
+func (file *VirtViewerFile) Bytes() []byte {
+	var out bytes.Buffer
+
+	fmt.Fprintf(&out, "[%s]\n", virtViewerSection)
+	for _, key := range file.keys {
+		fmt.Fprintf(&out, "%s=%s\n", key, file.values[key])
+	}
+
+	return out.Bytes()
+}
+
+// connectionFileDir is a directory only we can get into, for connection files to sit in while the viewer reads them.
+// The per-user runtime directory is preferred since it's never on a disk that outlives a reboot
+func connectionFileDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("pve-vdi-%d", os.Getuid()))
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		dir = filepath.Join(runtimeDir, "pve-vdi")
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("error while creating %s: %+v\n", dir, err)
+	}
+
+	// In a shared /tmp somebody else could have made it first, so make sure it's really ours
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", fmt.Errorf("error while checking %s: %+v\n", dir, err)
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || (ok && int(stat.Uid) != os.Getuid()) {
+		return "", fmt.Errorf("%s isn't a directory owned by us, refusing to use it\n", dir)
+	}
+
+	if info.Mode().Perm() != 0700 {
+		err = os.Chmod(dir, 0700)
+		if err != nil {
+			return "", fmt.Errorf("error while securing %s: %+v\n", dir, err)
+		}
+	}
+
+	return dir, nil
+}
+
+// writeConnectionFile saves data to a new file only the user can read, returning its path. pattern is as for
+// os.CreateTemp, such as "*.vv"
+func writeConnectionFile(data []byte, pattern string) (string, error) {
+	dir, err := connectionFileDir()
+	if err != nil {
+		return "", err
+	}
+
+	// CreateTemp makes the file 0600 and never reuses an existing one
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", fmt.Errorf("error while creating connection file: %+v\n", err)
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("error while writing connection file %s: %+v\n", file.Name(), err)
+	}
+
+	return file.Name(), nil
+}
+
+// removeConnectionFile deletes a connection file, which remote-viewer may well have done already
+func removeConnectionFile(filename string) {
+	err := os.Remove(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Couldn't remove connection file %s: %+v\n", filename, err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import "testing"
+
+func TestParseVirtViewerFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "file from PVE",
+			data: "[virt-viewer]\ntype=spice\nhost=pvespiceproxy:abc\npassword=secret\ntls-port=61000\nproxy=http://pve1:3128\n",
+			want: "[virt-viewer]\ntype=spice\nhost=pvespiceproxy:abc\npassword=secret\ntls-port=61000\nproxy=http://pve1:3128\n",
+		},
+		{
+			name: "values keep everything after the first =",
+			data: "[virt-viewer]\nca=-----BEGIN CERTIFICATE-----\\nMIIB==\\n\npassword=a=b=\n",
+			want: "[virt-viewer]\nca=-----BEGIN CERTIFICATE-----\\nMIIB==\\n\npassword=a=b=\n",
+		},
+		{
+			name: "whitespace, CRLF and comments",
+			data: "# made by PVE\r\n[ virt-viewer ]\r\n; a comment\r\n\r\n  type = spice \r\nhost=pve1\r\n",
+			want: "[virt-viewer]\ntype=spice\nhost=pve1\n",
+		},
+		{
+			name: "other sections are dropped",
+			data: "[ovirt]\nhost=engine\n[virt-viewer]\ntype=vnc\n[extra]\ntype=spice\n",
+			want: "[virt-viewer]\ntype=vnc\n",
+		},
+		{
+			name: "repeated keys keep their first place and last value",
+			data: "[virt-viewer]\ntype=spice\nhost=pve1\ntype=vnc\n",
+			want: "[virt-viewer]\ntype=vnc\nhost=pve1\n",
+		},
+		{
+			name: "keys before any section are ignored",
+			data: "type=vnc\n[virt-viewer]\nhost=pve1\n",
+			want: "[virt-viewer]\nhost=pve1\n",
+		},
+		{
+			name: "empty file",
+			data: "",
+			want: "[virt-viewer]\n",
+		},
+		{
+			name:    "line that isn't key=value",
+			data:    "[virt-viewer]\ntype=spice\n<html>\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := parseVirtViewerFile([]byte(test.data))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseVirtViewerFile() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if got := string(file.Bytes()); got != test.want {
+				t.Errorf("Bytes() = %q, want %q", got, test.want)
+			}
+
+			// Whatever we write has to read back the same
+			reparsed, err := parseVirtViewerFile(file.Bytes())
+			if err != nil {
+				t.Fatalf("parseVirtViewerFile(Bytes()) error = %v", err)
+			}
+			if got := string(reparsed.Bytes()); got != test.want {
+				t.Errorf("round trip = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVirtViewerFileSet(t *testing.T) {
+	file, err := parseVirtViewerFile([]byte("[virt-viewer]\ntype=spice\nfullscreen=0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.SetBool("fullscreen", true)
+	file.Set("title", "Windows 11")
+	file.SetIfNotEmpty("release-cursor", "")
+	file.SetBool("delete-this-file", false)
+
+	want := "[virt-viewer]\ntype=spice\nfullscreen=1\ntitle=Windows 11\ndelete-this-file=0\n"
+	if got := string(file.Bytes()); got != want {
+		t.Errorf("Bytes() = %q, want %q", got, want)
+	}
+}
+
+func TestVirtViewerFileValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"spice with tls-port", "[virt-viewer]\ntype=spice\nhost=h\npassword=p\ntls-port=61000\n", false},
+		{"vnc with port", "[virt-viewer]\ntype=vnc\nhost=h\npassword=p\nport=5900\n", false},
+		{"no password", "[virt-viewer]\ntype=spice\nhost=h\ntls-port=61000\n", true},
+		{"no port at all", "[virt-viewer]\ntype=spice\nhost=h\npassword=p\n", true},
+		{"unsupported type", "[virt-viewer]\ntype=ovirt\nhost=h\npassword=p\nport=1\n", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := parseVirtViewerFile([]byte(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := file.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyConnectionFileSettingsKiosk(t *testing.T) {
+	template := ProxmoxVm{Type: "qemu", VmNumber: 900, Name: "Windows 11"}
+	config = VdiConfig{
+		Kiosk:     KioskConfig{Enabled: true},
+		Templates: map[string]TemplateConfig{"900": {ConnectionFile: ConnectionFileSettings{Extra: map[string]string{"kiosk": "0", "kiosk-quit": "never"}}}},
+	}
+	t.Cleanup(func() { config = VdiConfig{} })
+
+	file, err := parseVirtViewerFile([]byte("[virt-viewer]\ntype=spice\nhost=h\npassword=p\ntls-port=61000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConnectionFileSettings(file, template); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{"kiosk": "1", "kiosk-quit": "on-disconnect", "fullscreen": "1", "delete-this-file": "1"} {
+		if got := file.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
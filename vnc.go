@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+type ProxmoxVncProxy struct {
+	// PVE hands the port back as a string on some versions and a number on others
+	Port     interface{} `json:"port"`
+	Ticket   string      `json:"ticket"`
+	User     string      `json:"user"`
+	Upid     string      `json:"upid"`
+	Password string      `json:"password"`
+}
+
+type rawProxmoxVncProxy struct {
+	Data ProxmoxVncProxy `json:"data"`
+}
+
+// displayType is the kind of virtual graphics card a VM has, such as qxl or std
+func displayType(vmConfig ProxmoxVmConfig) string {
+	vga := vmConfig.Get("vga")
+	if vga == "" {
+		return "std"
+	}
+
+	for _, option := range strings.Split(vga, ",") {
+		key, value, found := strings.Cut(option, "=")
+		if !found {
+			return key
+		} else if strings.Compare(key, "type") == 0 {
+			return value
+		}
+	}
+
+	return "std"
+}
+
+// spiceAvailable reports whether PVE will give us a SPICE connection, which it only does for qxl displays
+func spiceAvailable(vmConfig ProxmoxVmConfig) bool {
+	return strings.HasPrefix(displayType(vmConfig), "qxl")
+}
+
+// getVncProxy asks PVE to open a VNC session on vm. The password is an ordinary VNC password, so any VNC viewer
+// can use it
+func getVncProxy(creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) (ProxmoxVncProxy, error) {
+	apiUrl := fmt.Sprintf("https://%s:8006/api2/json/nodes/%s/qemu/%d/vncproxy", creds.Address, vm.Node, vm.VmNumber)
+
+	data := url.Values{}
+	data.Set("websocket", "1")
+	data.Set("generate-password", "1")
+
+	response, err := proxmoxApiRequest(creds, token, http.MethodPost, apiUrl, data)
+	if err != nil {
+		return ProxmoxVncProxy{}, err
+	}
+
+	var parsedResponse rawProxmoxVncProxy
+	err = json.Unmarshal(response, &parsedResponse)
+	if err != nil {
+		return ProxmoxVncProxy{}, fmt.Errorf("error while unmarshalling json: %+v\n", err)
+	}
+
+	return parsedResponse.Data, nil
+}
+
+// VncBridge listens on a local port and relays the first connection to it through PVE's VNC websocket, so viewers
+// that only speak plain VNC can reach the desktop
+type VncBridge struct {
+	listener net.Listener
+	password string
+}
+
+// startVncBridge opens a VNC session on vm and starts listening for the viewer
+func startVncBridge(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, vm ProxmoxVm) (*VncBridge, error) {
+	vncProxy, err := getVncProxy(creds, token, vm)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening VNC session: %w\n", err)
+	}
+
+	// Only ever on loopback, anyone who can reach the port gets the desktop once they have the password
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("error while listening for the VNC viewer: %+v\n", err)
+	}
+
+	bridge := &VncBridge{listener: listener, password: vncProxy.Password}
+
+	websocketUrl := url.URL{
+		Scheme: "wss",
+		Host:   fmt.Sprintf("%s:8006", creds.Address),
+		Path:   fmt.Sprintf("/api2/json/nodes/%s/qemu/%d/vncwebsocket", vm.Node, vm.VmNumber),
+		RawQuery: url.Values{
+			"port":      {fmt.Sprint(vncProxy.Port)},
+			"vncticket": {vncProxy.Ticket},
+		}.Encode(),
+	}
+
+	go func() {
+		// PVE's VNC proxy only takes a single connection, so there's no point accepting more than one
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error while waiting for the VNC viewer: %+v\n", err)
+			}
+			return
+		}
+		defer conn.Close()
+
+		err = relayVnc(ctx, creds, token, websocketUrl.String(), conn)
+		if err != nil {
+			log.Printf("VNC connection to %d ended: %+v\n", vm.VmNumber, err)
+		}
+	}()
+
+	return bridge, nil
+}
+
+// Host and Port are where the viewer should connect
+func (bridge *VncBridge) Host() string {
+	return bridge.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+func (bridge *VncBridge) Port() int {
+	return bridge.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (bridge *VncBridge) Password() string {
+	return bridge.password
+}
+
+// Close stops waiting for the viewer. A connection that's already being relayed carries on until the viewer hangs up
+func (bridge *VncBridge) Close() {
+	bridge.listener.Close()
+}
+
+// ConnectionFile describes the bridge as a .vv file, so VNC goes through the same viewers as SPICE
+func (bridge *VncBridge) ConnectionFile(template ProxmoxVm) (*VirtViewerFile, error) {
+	file := newVirtViewerFile()
+	file.Set("type", "vnc")
+	file.Set("host", bridge.Host())
+	file.Set("port", fmt.Sprint(bridge.Port()))
+	file.Set("password", bridge.Password())
+
+	err := applyConnectionFileSettings(file, template)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// relayVnc copies conn to and from PVE's VNC websocket until either side hangs up
+func relayVnc(ctx context.Context, creds ProxmoxCreds, token ProxmoxAuth, websocketUrl string, conn net.Conn) error {
+	dialer := websocket.Dialer{
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: true},
+		Subprotocols:     []string{"binary"},
+		HandshakeTimeout: client.Timeout,
+	}
+
+	header := http.Header{}
+	header.Add("Cookie", (&http.Cookie{Name: "PVEAuthCookie", Value: token.Data.Ticket}).String())
+
+	ws, resp, err := dialer.DialContext(ctx, websocketUrl, header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("error while connecting to VNC websocket: %+v: %s\n", err, resp.Status)
+		}
+		return fmt.Errorf("error while connecting to VNC websocket: %+v\n", err)
+	}
+	defer ws.Close()
+
+	errs := make(chan error, 2)
+
+	// Viewer to PVE
+	go func() {
+		buffer := make([]byte, 32*1024)
+		for {
+			read, err := conn.Read(buffer)
+			if read > 0 {
+				if writeErr := ws.WriteMessage(websocket.BinaryMessage, buffer[:read]); writeErr != nil {
+					errs <- writeErr
+					return
+				}
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	// PVE to viewer
+	go func() {
+		for {
+			_, reader, err := ws.NextReader()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			_, err = io.Copy(conn, reader)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	err = <-errs
+	if errors.Is(err, io.EOF) || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		return nil
+	}
+
+	return err
+}